@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/spf13/cobra"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+type (
+	healthFlags struct {
+		adminPort int
+		path      string
+		url       string
+		timeout   time.Duration
+	}
+)
+
+func (c *Cmd) getHealthcheckCmd() *cobra.Command {
+	healthCmd := &cobra.Command{
+		Use:               "healthcheck",
+		Short:             "Probes the health of a local server",
+		Long:              `Probes the health of a local server on its admin listener and exits non-zero if it is unhealthy`,
+		Run:               c.execHealthcheck,
+		DisableAutoGenTag: true,
+	}
+	healthCmd.PersistentFlags().IntVar(&c.healthFlags.adminPort, "admin-port", 0, "port of the admin http server")
+	healthCmd.PersistentFlags().StringVar(&c.healthFlags.path, "path", "/healthz", "probe endpoint path")
+	healthCmd.PersistentFlags().StringVar(&c.healthFlags.url, "url", "", "probe url (default is derived from the first admin listener)")
+	healthCmd.PersistentFlags().DurationVar(&c.healthFlags.timeout, "timeout", 5*time.Second, "probe timeout")
+	return healthCmd
+}
+
+// loopbackHost returns the host to probe a tcp listener addr on
+func loopbackHost(host string) string {
+	if host == "" {
+		return "localhost"
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !ip.IsUnspecified() {
+		return host
+	}
+	if ip.Is4() {
+		return "127.0.0.1"
+	}
+	return "::1"
+}
+
+// probeTarget returns the url and transport to probe the first configured
+// admin listener
+func (c *Cmd) probeTarget() (string, *http.Transport, error) {
+	transport := &http.Transport{
+		// the server cert is not expected to be valid for a local address
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}
+	if c.healthFlags.url != "" {
+		return c.healthFlags.url, transport, nil
+	}
+	listeners, err := c.readAdminListeners(c.healthFlags.adminPort)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(listeners) == 0 {
+		return "", nil, kerrors.WithMsg(nil, "No admin listeners configured")
+	}
+	l := listeners[0]
+	scheme := "http"
+	if l.TLS {
+		scheme = "https"
+	}
+	switch l.Network {
+	case "tcp":
+		host, port, err := net.SplitHostPort(l.Addr)
+		if err != nil {
+			return "", nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid listener addr %s", l.Addr))
+		}
+		return scheme + "://" + net.JoinHostPort(loopbackHost(host), port) + c.healthFlags.path, transport, nil
+	case "unix":
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", l.Addr)
+		}
+		return scheme + "://localhost" + c.healthFlags.path, transport, nil
+	default:
+		return "", nil, kerrors.WithMsg(nil, fmt.Sprintf("Unable to probe %s listener, use the url flag", l.Network))
+	}
+}
+
+func (c *Cmd) execHealthcheck(cmd *cobra.Command, args []string) {
+	u, transport, err := c.probeTarget()
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   c.healthFlags.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(u)
+	if err != nil {
+		c.logFatal(kerrors.WithMsg(err, "Failed to probe server"))
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		c.logFatal(kerrors.WithMsg(nil, fmt.Sprintf("Server unhealthy with status %d", res.StatusCode)))
+		return
+	}
+	c.log.Debug(context.Background(), "Server healthy",
+		klog.AString("url", u),
+	)
+}
@@ -16,13 +16,16 @@ import (
 
 type (
 	Cmd struct {
-		rootCmd    *cobra.Command
-		log        *klog.LevelLogger
-		version    string
-		rootFlags  rootFlags
-		serveFlags serveFlags
-		treeFlags  treeFlags
-		docFlags   docFlags
+		rootCmd     *cobra.Command
+		log         *klog.LevelLogger
+		version     string
+		buildinfo   VCSBuildInfo
+		rootFlags   rootFlags
+		serveFlags  serveFlags
+		treeFlags   treeFlags
+		shareFlags  shareFlags
+		healthFlags healthFlags
+		docFlags    docFlags
 	}
 
 	rootFlags struct {
@@ -37,8 +40,8 @@ func New() *Cmd {
 }
 
 func (c *Cmd) Execute() {
-	buildinfo := ReadVCSBuildInfo()
-	c.version = buildinfo.ModVersion
+	c.buildinfo = ReadVCSBuildInfo()
+	c.version = c.buildinfo.ModVersion
 	rootCmd := &cobra.Command{
 		Use:               "fsserve",
 		Short:             "A file system http server",
@@ -57,17 +60,39 @@ func (c *Cmd) Execute() {
 	viper.SetDefault("base", "")
 	viper.SetDefault("exttotype", []serve.MimeType{})
 	viper.SetDefault("routes", []serve.Route{})
+	viper.SetDefault("redirects", []serve.Rule{})
+	viper.SetDefault("rewrites", []serve.Rule{})
+	viper.SetDefault("listeners", []serve.Listener{})
+	viper.SetDefault("adminlisteners", []serve.Listener{})
+	viper.SetDefault("adminport", 0)
 	viper.SetDefault("maxheadersize", "1M")
 	viper.SetDefault("maxconnread", "5s")
 	viper.SetDefault("maxconnheader", "2s")
 	viper.SetDefault("maxconnwrite", "5s")
 	viper.SetDefault("maxconnidle", "5s")
 	viper.SetDefault("gracefulshutdown", "5s")
+	viper.SetDefault("tls.cert", "")
+	viper.SetDefault("tls.key", "")
+	viper.SetDefault("tls.minversion", "1.2")
+	viper.SetDefault("tls.ciphersuites", []string{})
+	viper.SetDefault("tls.reloadinterval", "30s")
+	viper.SetDefault("tls.hsts", "")
+	viper.SetDefault("tls.redirectport", 0)
+	viper.SetDefault("tls.clientca", []string{})
+	viper.SetDefault("compresscache.dir", "")
+	viper.SetDefault("compresscache.maxsize", "64M")
+	viper.SetDefault("signurl.key", "")
+	viper.SetDefault("signurl.keyfile", "")
+	viper.SetDefault("accesslog.file", "")
+	viper.SetDefault("accesslog.format", "combined")
+	viper.SetDefault("accesslog.fields", map[string]string{})
 
 	c.rootCmd = rootCmd
 
 	rootCmd.AddCommand(c.getServeCmd())
 	rootCmd.AddCommand(c.getTreeCmd())
+	rootCmd.AddCommand(c.getShareCmd())
+	rootCmd.AddCommand(c.getHealthcheckCmd())
 	rootCmd.AddCommand(c.getDocCmd())
 
 	if err := rootCmd.Execute(); err != nil {
@@ -3,6 +3,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/netip"
 	"os"
 	"os/signal"
@@ -22,8 +23,9 @@ import (
 
 type (
 	serveFlags struct {
-		port int
-		base string
+		port      int
+		adminPort int
+		base      string
 	}
 )
 
@@ -36,33 +38,33 @@ func (c *Cmd) getServeCmd() *cobra.Command {
 		DisableAutoGenTag: true,
 	}
 	serveCmd.PersistentFlags().IntVarP(&c.serveFlags.port, "port", "p", 0, "port to run the http server on (default 8080)")
+	serveCmd.PersistentFlags().IntVar(&c.serveFlags.adminPort, "admin-port", 0, "port to run the admin http server on")
 	return serveCmd
 }
 
-func (c *Cmd) execServe(cmd *cobra.Command, args []string) {
-	var mimeTypes []serve.MimeType
-	if err := viper.UnmarshalKey("exttotype", &mimeTypes); err != nil {
-		c.logFatal(kerrors.WithMsg(err, "Failed to read config exttotype"))
-		return
-	}
-	if err := serve.AddMimeTypes(mimeTypes); err != nil {
-		c.logFatal(kerrors.WithMsg(err, "Failed to set ext to mime types"))
-		return
+type (
+	reloadableConfig struct {
+		routes  []serve.Route
+		rules   serve.Rules
+		proxies []netip.Prefix
+		globals serve.Globals
 	}
-	c.log.Info(context.Background(), "Added ext mime types",
-		klog.AAny("mimetypes", mimeTypes),
-	)
+)
 
+// readReloadableConfig reads the config that may be changed while the server
+// is running
+func (c *Cmd) readReloadableConfig() (*reloadableConfig, error) {
 	var routes []serve.Route
 	if err := viper.UnmarshalKey("routes", &routes); err != nil {
-		c.logFatal(kerrors.WithMsg(err, "Failed to read config routes"))
-		return
+		return nil, kerrors.WithMsg(err, "Failed to read config routes")
 	}
 
-	instance, err := serve.NewRandSnowflake()
-	if err != nil {
-		c.logFatal(kerrors.WithMsg(err, "Failed to generate instance id"))
-		return
+	var rules serve.Rules
+	if err := viper.UnmarshalKey("redirects", &rules.Redirects); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read config redirects")
+	}
+	if err := viper.UnmarshalKey("rewrites", &rules.Rewrites); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read config rewrites")
 	}
 
 	proxystrs := viper.GetStringSlice("proxies")
@@ -70,15 +72,127 @@ func (c *Cmd) execServe(cmd *cobra.Command, args []string) {
 	for _, i := range proxystrs {
 		k, err := netip.ParsePrefix(i)
 		if err != nil {
-			c.logFatal(kerrors.WithMsg(err, "Invalid proxy CIDR"))
-			return
+			return nil, kerrors.WithMsg(err, "Invalid proxy CIDR")
 		}
 		proxies = append(proxies, k)
 	}
+
+	var globals serve.Globals
+	if err := viper.UnmarshalKey("exttotype", &globals.MimeTypes); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read config exttotype")
+	}
+	if err := viper.UnmarshalKey("errorpages", &globals.ErrorPages); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read config errorpages")
+	}
+	if err := viper.UnmarshalKey("ipfilter", &globals.IPFilter); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read config ipfilter")
+	}
+	if err := viper.UnmarshalKey("ratelimit", &globals.RateLimit); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read config ratelimit")
+	}
+	if err := viper.UnmarshalKey("accesslog", &globals.AccessLog); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read config accesslog")
+	}
+
+	return &reloadableConfig{
+		routes:  routes,
+		rules:   rules,
+		proxies: proxies,
+		globals: globals,
+	}, nil
+}
+
+// readListeners reads the config listeners, and falls back to a tcp listener
+// on port
+func (c *Cmd) readListeners(port int, useTLS bool) ([]serve.Listener, error) {
+	var listeners []serve.Listener
+	if err := viper.UnmarshalKey("listeners", &listeners); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read config listeners")
+	}
+	if len(listeners) == 0 {
+		if port == 0 {
+			port = viper.GetInt("port")
+			if port == 0 {
+				port = 8080
+			}
+		}
+		listeners = []serve.Listener{
+			{
+				Network: "tcp",
+				Addr:    ":" + strconv.Itoa(port),
+				TLS:     useTLS,
+			},
+		}
+	} else if port != 0 {
+		c.log.Warn(context.Background(), "Ignoring port flag since listeners are configured")
+	}
+	return listeners, nil
+}
+
+// readAdminListeners reads the config admin listeners, and falls back to a tcp
+// listener on port if it is set
+func (c *Cmd) readAdminListeners(port int) ([]serve.Listener, error) {
+	var listeners []serve.Listener
+	if err := viper.UnmarshalKey("adminlisteners", &listeners); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read config admin listeners")
+	}
+	if len(listeners) == 0 {
+		if port == 0 {
+			port = viper.GetInt("adminport")
+		}
+		if port != 0 {
+			listeners = []serve.Listener{
+				{
+					Network: "tcp",
+					Addr:    ":" + strconv.Itoa(port),
+				},
+			}
+		}
+	} else if port != 0 {
+		c.log.Warn(context.Background(), "Ignoring admin port flag since admin listeners are configured")
+	}
+	return listeners, nil
+}
+
+func (c *Cmd) execServe(cmd *cobra.Command, args []string) {
+	cfg, err := c.readReloadableConfig()
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+
+	instance, err := serve.NewRandSnowflake()
+	if err != nil {
+		c.logFatal(kerrors.WithMsg(err, "Failed to generate instance id"))
+		return
+	}
+
 	c.log.Info(context.Background(), "Trusted proxies",
-		klog.AAny("realip.proxies", proxystrs),
+		klog.AAny("realip.proxies", cfg.proxies),
 	)
 
+	signKey, err := c.readSignKey()
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+
+	var accessLogFile *serve.AccessLogFile
+	var accessLogWriter io.Writer
+	if name := viper.GetString("accesslog.file"); name != "" {
+		accessLogFile, err = serve.OpenAccessLogFile(name)
+		if err != nil {
+			c.logFatal(err)
+			return
+		}
+		defer func() {
+			if err := accessLogFile.Close(); err != nil {
+				c.log.Err(context.Background(), err)
+			}
+		}()
+		accessLogWriter = accessLogFile
+	}
+
 	contentDir := c.getBaseFS()
 
 	s := serve.NewServer(
@@ -86,19 +200,39 @@ func (c *Cmd) execServe(cmd *cobra.Command, args []string) {
 		contentDir,
 		serve.Config{
 			Instance: instance.Base64(),
-			Proxies:  proxies,
+			Proxies:  cfg.proxies,
+			CompressCache: serve.CompressCacheConfig{
+				Dir:     viper.GetString("compresscache.dir"),
+				MaxSize: int64(c.readBytesConfig(viper.GetString("compresscache.maxsize"), 64*MEGABYTE)),
+			},
+			ErrorPages:      cfg.globals.ErrorPages,
+			IPFilter:        cfg.globals.IPFilter,
+			RateLimit:       cfg.globals.RateLimit,
+			SignKey:         signKey,
+			AccessLog:       cfg.globals.AccessLog,
+			AccessLogWriter: accessLogWriter,
+			BuildInfo: serve.BuildInfo{
+				Version:   c.buildinfo.ModVersion,
+				VCS:       c.buildinfo.VCSStr(),
+				VCSTime:   c.buildinfo.VCSTime,
+				GoVersion: c.buildinfo.GoVersion,
+			},
 		},
 	)
-	if err := s.Mount(routes); err != nil {
+	if err := s.Reload(cfg.routes, cfg.rules, cfg.proxies, cfg.globals); err != nil {
 		c.logFatal(kerrors.WithMsg(err, "Failed to mount server routes"))
 	}
 
-	port := c.serveFlags.port
-	if port == 0 {
-		port = viper.GetInt("port")
-		if port == 0 {
-			port = 8080
-		}
+	tlsOpts := c.readTLSConfig()
+	listeners, err := c.readListeners(c.serveFlags.port, tlsOpts.Enabled())
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+	adminListeners, err := c.readAdminListeners(c.serveFlags.adminPort)
+	if err != nil {
+		c.logFatal(err)
+		return
 	}
 
 	opts := serve.Opts{
@@ -108,6 +242,9 @@ func (c *Cmd) execServe(cmd *cobra.Command, args []string) {
 		IdleTimeout:       c.readDurationConfig(viper.GetString("maxconnidle"), seconds5),
 		MaxHeaderBytes:    c.readBytesConfig(viper.GetString("maxheadersize"), MEGABYTE),
 		GracefulShutdown:  c.readDurationConfig(viper.GetString("gracefulshutdown"), seconds5),
+		Listeners:         listeners,
+		AdminListeners:    adminListeners,
+		TLS:               tlsOpts,
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -118,24 +255,91 @@ func (c *Cmd) execServe(cmd *cobra.Command, args []string) {
 	go func() {
 		defer wg.Done()
 		defer cancel()
-		s.Serve(ctx, port, opts)
+		s.Serve(ctx, opts)
 	}()
 
-	waitForInterrupt(ctx)
+	c.waitForSignals(ctx, s, accessLogFile)
 
 	cancel()
 	wg.Wait()
 }
 
-func waitForInterrupt(ctx context.Context) {
-	notifyCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
-	defer stop()
-	<-notifyCtx.Done()
+func (c *Cmd) readTLSConfig() serve.TLSOpts {
+	minVersion, err := serve.ParseTLSVersion(viper.GetString("tls.minversion"))
+	if err != nil {
+		c.logFatal(kerrors.WithMsg(err, "Invalid config tls.minversion"))
+		return serve.TLSOpts{}
+	}
+	cipherSuites, err := serve.ParseCipherSuites(viper.GetStringSlice("tls.ciphersuites"))
+	if err != nil {
+		c.logFatal(kerrors.WithMsg(err, "Invalid config tls.ciphersuites"))
+		return serve.TLSOpts{}
+	}
+	return serve.TLSOpts{
+		CertFile:       viper.GetString("tls.cert"),
+		KeyFile:        viper.GetString("tls.key"),
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		ReloadInterval: c.readDurationConfig(viper.GetString("tls.reloadinterval"), seconds30),
+		HSTS:           viper.GetString("tls.hsts"),
+		RedirectPort:   viper.GetInt("tls.redirectport"),
+		ClientCAFiles:  viper.GetStringSlice("tls.clientca"),
+	}
+}
+
+// waitForSignals reloads the server on SIGHUP and returns on interrupt
+func (c *Cmd) waitForSignals(ctx context.Context, s *serve.Server, accessLogFile *serve.AccessLogFile) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGHUP:
+				if err := c.reloadServer(s); err != nil {
+					c.log.Err(context.Background(), kerrors.WithMsg(err, "Failed to reload config"))
+				}
+			case syscall.SIGUSR1:
+				if accessLogFile == nil {
+					continue
+				}
+				if err := accessLogFile.Reopen(); err != nil {
+					c.log.Err(context.Background(), kerrors.WithMsg(err, "Failed to reopen access log"))
+				} else {
+					c.log.Info(context.Background(), "Reopened access log")
+				}
+			default:
+				return
+			}
+		}
+	}
+}
+
+func (c *Cmd) reloadServer(s *serve.Server) error {
+	c.log.Info(context.Background(), "Reloading config")
+	if err := viper.ReadInConfig(); err != nil {
+		return kerrors.WithMsg(err, "Failed reading config")
+	}
+	cfg, err := c.readReloadableConfig()
+	if err != nil {
+		return err
+	}
+	if err := s.Reload(cfg.routes, cfg.rules, cfg.proxies, cfg.globals); err != nil {
+		return kerrors.WithMsg(err, "Failed to mount server routes")
+	}
+	c.log.Info(context.Background(), "Reloaded config",
+		klog.AAny("realip.proxies", cfg.proxies),
+	)
+	return nil
 }
 
 const (
-	seconds5 = 5 * time.Second
-	seconds2 = 2 * time.Second
+	seconds30 = 30 * time.Second
+	seconds5  = 5 * time.Second
+	seconds2  = 2 * time.Second
 )
 
 func (c *Cmd) readDurationConfig(s string, d time.Duration) time.Duration {
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"xorkevin.dev/fsserve/serve"
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	shareFlags struct {
+		ttl    time.Duration
+		origin string
+	}
+)
+
+func (c *Cmd) getShareCmd() *cobra.Command {
+	shareCmd := &cobra.Command{
+		Use:               "share <path>",
+		Short:             "Prints a signed url for a path",
+		Long:              `Prints a signed url for a path which expires after a ttl. The path may include a query, which is also signed, such as /dl/report.txt?lang=en.`,
+		Args:              cobra.ExactArgs(1),
+		Run:               c.execShare,
+		DisableAutoGenTag: true,
+	}
+	shareCmd.PersistentFlags().DurationVar(&c.shareFlags.ttl, "ttl", 24*time.Hour, "time until the url expires")
+	shareCmd.PersistentFlags().StringVar(&c.shareFlags.origin, "origin", "", "url origin prepended to the signed path")
+
+	return shareCmd
+}
+
+// readSignKey reads the url signing key from the config key file, and falls
+// back to the config key
+func (c *Cmd) readSignKey() ([]byte, error) {
+	if keyfile := viper.GetString("signurl.keyfile"); keyfile != "" {
+		b, err := os.ReadFile(keyfile)
+		if err != nil {
+			return nil, kerrors.WithMsg(err, "Failed to read signurl keyfile")
+		}
+		return []byte(strings.TrimSpace(string(b))), nil
+	}
+	if key := viper.GetString("signurl.key"); key != "" {
+		return []byte(key), nil
+	}
+	return nil, nil
+}
+
+func (c *Cmd) execShare(cmd *cobra.Command, args []string) {
+	if c.shareFlags.ttl <= 0 {
+		c.logFatal(kerrors.WithMsg(nil, "TTL must be positive"))
+		return
+	}
+	key, err := c.readSignKey()
+	if err != nil {
+		c.logFatal(err)
+		return
+	}
+	u, err := serve.SignURL(key, args[0], time.Now().Add(c.shareFlags.ttl))
+	if err != nil {
+		c.logFatal(kerrors.WithMsg(err, "Failed to sign url"))
+		return
+	}
+	fmt.Println(strings.TrimSuffix(c.shareFlags.origin, "/") + u)
+}
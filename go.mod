@@ -3,6 +3,8 @@ module xorkevin.dev/fsserve
 go 1.22.0
 
 require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.0
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/spf13/cobra v1.8.1
 	github.com/spf13/viper v1.19.0
@@ -0,0 +1,310 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"xorkevin.dev/fsserve/util/kjson"
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	// AccessLog is an access log config
+	//
+	// Format may be one of combined, common, or json, and defaults to
+	// combined. The combined format is followed by the quoted lreqid, route
+	// prefix, and content encoding, and the latency in microseconds. Fields
+	// maps json access log fields to their output keys, and selects all fields
+	// with their default names if empty.
+	AccessLog struct {
+		Format string            `mapstructure:"format"`
+		Fields map[string]string `mapstructure:"fields"`
+	}
+
+	accessLogFormat struct {
+		format string
+		fields []accessLogField
+	}
+
+	accessLogField struct {
+		name string
+		key  string
+	}
+
+	accessLogEntry struct {
+		time      time.Time
+		remoteIP  string
+		principal string
+		lreqid    string
+		method    string
+		path      string
+		proto     string
+		host      string
+		status    int
+		bytes     uint64
+		referer   string
+		userAgent string
+		route     string
+		encoding  string
+		latency   time.Duration
+	}
+
+	// AccessLogFile is an append only access log file which may be reopened
+	// after it is rotated. It is safe for concurrent use.
+	AccessLogFile struct {
+		name string
+		mu   sync.Mutex
+		f    *os.File
+	}
+)
+
+const (
+	accessLogFormatCombined = "combined"
+	accessLogFormatCommon   = "common"
+	accessLogFormatJSON     = "json"
+
+	clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLogFieldNames are the json access log fields in output order
+var accessLogFieldNames = []string{
+	"time",
+	"remote_ip",
+	"principal",
+	"lreqid",
+	"method",
+	"path",
+	"proto",
+	"host",
+	"status",
+	"bytes",
+	"referer",
+	"user_agent",
+	"route",
+	"encoding",
+	"latency_us",
+}
+
+func parseAccessLog(a AccessLog) (*accessLogFormat, error) {
+	f := &accessLogFormat{
+		format: a.Format,
+	}
+	switch a.Format {
+	case "":
+		f.format = accessLogFormatCombined
+	case accessLogFormatCombined, accessLogFormatCommon:
+	case accessLogFormatJSON:
+		for k, v := range a.Fields {
+			if !slices.Contains(accessLogFieldNames, k) {
+				return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid access log field %s", k))
+			}
+			if v == "" {
+				return nil, kerrors.WithMsg(nil, fmt.Sprintf("Empty key for access log field %s", k))
+			}
+		}
+		for _, i := range accessLogFieldNames {
+			if len(a.Fields) == 0 {
+				f.fields = append(f.fields, accessLogField{name: i, key: i})
+			} else if key, ok := a.Fields[i]; ok {
+				f.fields = append(f.fields, accessLogField{name: i, key: key})
+			}
+		}
+	default:
+		return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid access log format %s", a.Format))
+	}
+	return f, nil
+}
+
+// escapeLogValue escapes quotes, backslashes, and control and non-ascii bytes
+// of a log line value
+func escapeLogValue(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' || c == '\\' || c < 0x20 || c >= 0x7f {
+			fmt.Fprintf(&b, `\x%02X`, c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func clfValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return escapeLogValue(s)
+}
+
+func (e accessLogEntry) fieldValue(name string) any {
+	switch name {
+	case "time":
+		return e.time.Format(time.RFC3339Nano)
+	case "remote_ip":
+		return e.remoteIP
+	case "principal":
+		return e.principal
+	case "lreqid":
+		return e.lreqid
+	case "method":
+		return e.method
+	case "path":
+		return e.path
+	case "proto":
+		return e.proto
+	case "host":
+		return e.host
+	case "status":
+		return e.status
+	case "bytes":
+		return e.bytes
+	case "referer":
+		return e.referer
+	case "user_agent":
+		return e.userAgent
+	case "route":
+		return e.route
+	case "encoding":
+		return e.encoding
+	case "latency_us":
+		return e.latency.Microseconds()
+	default:
+		return nil
+	}
+}
+
+// formatLine formats an access log entry as a newline terminated line
+func (f *accessLogFormat) formatLine(e accessLogEntry) ([]byte, error) {
+	var b bytes.Buffer
+	if f.format == accessLogFormatJSON {
+		b.WriteByte('{')
+		for n, i := range f.fields {
+			if n > 0 {
+				b.WriteByte(',')
+			}
+			k, err := kjson.Marshal(i.key)
+			if err != nil {
+				return nil, kerrors.WithMsg(err, "Failed to marshal access log key")
+			}
+			v, err := kjson.Marshal(e.fieldValue(i.name))
+			if err != nil {
+				return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to marshal access log field %s", i.name))
+			}
+			// marshaled values are newline terminated
+			b.Write(bytes.TrimSuffix(k, []byte{'\n'}))
+			b.WriteByte(':')
+			b.Write(bytes.TrimSuffix(v, []byte{'\n'}))
+		}
+		b.WriteString("}\n")
+		return b.Bytes(), nil
+	}
+
+	size := "-"
+	if e.bytes > 0 {
+		size = strconv.FormatUint(e.bytes, 10)
+	}
+	fmt.Fprintf(&b, `%s - %s [%s] "%s %s %s" %d %s`,
+		clfValue(e.remoteIP),
+		clfValue(e.principal),
+		e.time.Format(clfTimeLayout),
+		escapeLogValue(e.method),
+		escapeLogValue(e.path),
+		escapeLogValue(e.proto),
+		e.status,
+		size,
+	)
+	if f.format == accessLogFormatCombined {
+		fmt.Fprintf(&b, ` "%s" "%s" "%s" "%s" "%s" %d`,
+			clfValue(e.referer),
+			clfValue(e.userAgent),
+			clfValue(e.lreqid),
+			clfValue(e.route),
+			clfValue(e.encoding),
+			e.latency.Microseconds(),
+		)
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+func openAppendFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to open access log file %s", name))
+	}
+	return f, nil
+}
+
+// OpenAccessLogFile opens an access log file for appending
+func OpenAccessLogFile(name string) (*AccessLogFile, error) {
+	f, err := openAppendFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogFile{
+		name: name,
+		f:    f,
+	}, nil
+}
+
+// Write writes a log line to the file
+func (l *AccessLogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return 0, kerrors.WithMsg(os.ErrClosed, "Access log file is closed")
+	}
+	return l.f.Write(p)
+}
+
+// Reopen reopens the file by name so that writes go to a new file after the
+// previous file is rotated
+func (l *AccessLogFile) Reopen() error {
+	f, err := openAppendFile(l.name)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	prev := l.f
+	l.f = f
+	l.mu.Unlock()
+	if prev != nil {
+		if err := prev.Close(); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed to close previous access log file %s", l.name))
+		}
+	}
+	return nil
+}
+
+// Close closes the file
+func (l *AccessLogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	if err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed to close access log file %s", l.name))
+	}
+	return nil
+}
+
+func (s *Server) writeAccessLog(ctx context.Context, f *accessLogFormat, e accessLogEntry) {
+	line, err := f.formatLine(e)
+	if err != nil {
+		s.log.Err(ctx, kerrors.WithMsg(err, "Failed to format access log line"))
+		return
+	}
+	if _, err := s.config.AccessLogWriter.Write(line); err != nil {
+		s.log.Err(ctx, kerrors.WithMsg(err, "Failed to write access log line"))
+	}
+}
@@ -0,0 +1,288 @@
+package serve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+type (
+	// Auth is a route authentication config
+	//
+	// BasicFile is a file of user:hash lines, where hash is a bcrypt hash or an
+	// argon2id PHC string. TokenFiles are files of name:token lines, and
+	// TokenEnvs are environment variables each containing a token named by the
+	// variable. Realm is the realm of WWW-Authenticate challenges. Credentials
+	// are loaded when routes are mounted.
+	Auth struct {
+		Realm      string   `mapstructure:"realm"`
+		BasicFile  string   `mapstructure:"basic_file"`
+		TokenFiles []string `mapstructure:"token_files"`
+		TokenEnvs  []string `mapstructure:"token_envs"`
+		basic      map[string]string
+		tokens     []authToken
+	}
+
+	authToken struct {
+		name string
+		hash [sha256.Size]byte
+	}
+
+	// authPrincipal holds the authenticated principal of a request so that it
+	// may be logged by the server after the route handler returns
+	authPrincipal struct {
+		name string
+	}
+
+	ctxKeyPrincipal struct{}
+)
+
+const (
+	headerAuthorization   = "Authorization"
+	headerWWWAuthenticate = "WWW-Authenticate"
+
+	authSchemeBasic  = "Basic"
+	authSchemeBearer = "Bearer"
+
+	defaultAuthRealm = "fsserve"
+)
+
+var (
+	// dummyBcryptHash is compared against for unknown users so that a response
+	// does not reveal whether a user exists
+	dummyBcryptHash = sync.OnceValue(func() []byte {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		h, _ := bcrypt.GenerateFromPassword(b[:], bcrypt.DefaultCost)
+		return h
+	})
+)
+
+func getCtxPrincipal(ctx context.Context) *authPrincipal {
+	v, _ := ctx.Value(ctxKeyPrincipal{}).(*authPrincipal)
+	return v
+}
+
+func (a Auth) enabled() bool {
+	return a.BasicFile != "" || len(a.TokenFiles) > 0 || len(a.TokenEnvs) > 0
+}
+
+func readCredentialLines(name string) ([][2]string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read credentials file %s", name))
+	}
+	var res [][2]string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || k == "" || v == "" {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid credential on line %d of %s", lineno, name))
+		}
+		res = append(res, [2]string{k, v})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read credentials file %s", name))
+	}
+	return res, nil
+}
+
+func isSupportedPasswordHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$") ||
+		strings.HasPrefix(hash, "$argon2id$")
+}
+
+// loadAuth loads the credentials of a route
+func loadAuth(a *Auth, prefix string) error {
+	if a.Realm == "" {
+		a.Realm = defaultAuthRealm
+	}
+	if strings.ContainsAny(a.Realm, "\"\\") {
+		return kerrors.WithMsg(nil, fmt.Sprintf("Invalid auth realm for route %s", prefix))
+	}
+	a.basic = nil
+	if a.BasicFile != "" {
+		lines, err := readCredentialLines(a.BasicFile)
+		if err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Invalid basic auth file for route %s", prefix))
+		}
+		a.basic = make(map[string]string, len(lines))
+		for _, i := range lines {
+			if !isSupportedPasswordHash(i[1]) {
+				return kerrors.WithMsg(nil, fmt.Sprintf("Unsupported password hash for user %s of route %s", i[0], prefix))
+			}
+			a.basic[i[0]] = i[1]
+		}
+	}
+	a.tokens = nil
+	for _, i := range a.TokenFiles {
+		lines, err := readCredentialLines(i)
+		if err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Invalid token file for route %s", prefix))
+		}
+		for _, j := range lines {
+			a.tokens = append(a.tokens, authToken{
+				name: j[0],
+				hash: sha256.Sum256([]byte(j[1])),
+			})
+		}
+	}
+	for _, i := range a.TokenEnvs {
+		v := os.Getenv(i)
+		if v == "" {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Missing token env %s for route %s", i, prefix))
+		}
+		a.tokens = append(a.tokens, authToken{
+			name: i,
+			hash: sha256.Sum256([]byte(v)),
+		})
+	}
+	return nil
+}
+
+// verifyArgon2id verifies a password against an argon2id PHC string of the
+// form $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+func verifyArgon2id(hash string, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, kerrors.WithMsg(nil, "Malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, kerrors.WithMsg(err, "Unsupported argon2id version")
+	}
+	var mem, iter uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &iter, &threads); err != nil {
+		return false, kerrors.WithMsg(err, "Malformed argon2id params")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, kerrors.WithMsg(err, "Malformed argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, kerrors.WithMsg(err, "Malformed argon2id key")
+	}
+	k := argon2.IDKey([]byte(password), salt, iter, mem, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(k, key) == 1, nil
+}
+
+func (a Auth) verifyBasic(user, password string) (bool, error) {
+	hash, ok := a.basic[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyBcryptHash(), []byte(password))
+		return false, nil
+	}
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return verifyArgon2id(hash, password)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return false, kerrors.WithMsg(err, "Malformed bcrypt hash")
+	}
+	return true, nil
+}
+
+// verifyToken returns the name of a matching token. All tokens are compared
+// in constant time.
+func (a Auth) verifyToken(token string) (string, bool) {
+	h := sha256.Sum256([]byte(token))
+	var name string
+	found := 0
+	for _, i := range a.tokens {
+		if subtle.ConstantTimeCompare(h[:], i.hash[:]) == 1 && found == 0 {
+			name = i.name
+			found = 1
+		}
+	}
+	return name, found == 1
+}
+
+func (a Auth) challenge(w http.ResponseWriter, bearerErr string) {
+	realm := strconv.Quote(a.Realm)
+	if a.basic != nil {
+		w.Header().Add(headerWWWAuthenticate, authSchemeBasic+" realm="+realm+`, charset="UTF-8"`)
+	}
+	if len(a.TokenFiles) > 0 || len(a.TokenEnvs) > 0 {
+		v := authSchemeBearer + " realm=" + realm
+		if bearerErr != "" {
+			v += ", error=" + strconv.Quote(bearerErr)
+		}
+		w.Header().Add(headerWWWAuthenticate, v)
+	}
+}
+
+// authenticate returns the request with the authenticated principal added to
+// its log context, or an error after writing a challenge
+func (a Auth) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	if !a.enabled() {
+		return r, nil
+	}
+	scheme, cred, _ := strings.Cut(r.Header.Get(headerAuthorization), " ")
+	cred = strings.TrimSpace(cred)
+	var principal string
+	switch {
+	case strings.EqualFold(scheme, authSchemeBasic) && a.basic != nil:
+		b, err := base64.StdEncoding.DecodeString(cred)
+		if err != nil {
+			a.challenge(w, "")
+			return nil, kerrors.WithKind(err, ErrUnauthorized, "Malformed basic credentials")
+		}
+		user, password, ok := strings.Cut(string(b), ":")
+		if !ok {
+			a.challenge(w, "")
+			return nil, kerrors.WithKind(nil, ErrUnauthorized, "Malformed basic credentials")
+		}
+		ok, err = a.verifyBasic(user, password)
+		if err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to verify password for user %s", user))
+		}
+		if !ok {
+			a.challenge(w, "")
+			return nil, kerrors.WithKind(nil, ErrUnauthorized, fmt.Sprintf("Invalid password for user %s", user))
+		}
+		principal = "user:" + user
+	case strings.EqualFold(scheme, authSchemeBearer) && len(a.tokens) > 0:
+		name, ok := a.verifyToken(cred)
+		if !ok {
+			a.challenge(w, "invalid_token")
+			return nil, kerrors.WithKind(nil, ErrUnauthorized, "Invalid bearer token")
+		}
+		principal = "token:" + name
+	default:
+		a.challenge(w, "")
+		return nil, kerrors.WithKind(nil, ErrUnauthorized, "Missing credentials")
+	}
+	if p := getCtxPrincipal(r.Context()); p != nil {
+		p.name = principal
+	}
+	ctx := klog.CtxWithAttrs(r.Context(), klog.AString("http.principal", principal))
+	return r.WithContext(ctx), nil
+}
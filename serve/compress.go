@@ -0,0 +1,382 @@
+package serve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/blake2b"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+type (
+	// Compression is a route dynamic compression config
+	//
+	// Codes are the encodings that may be used to compress files which do not
+	// have a precompressed variant, in order of preference. Files larger than
+	// MaxSize, which defaults to 8MiB, or the compression cache max size are
+	// not compressed.
+	Compression struct {
+		Codes        []string `mapstructure:"codes"`
+		MinSize      int64    `mapstructure:"min_size"`
+		MaxSize      int64    `mapstructure:"max_size"`
+		ContentTypes []string `mapstructure:"content_types"`
+		maxSize      int64
+	}
+
+	// CompressCacheConfig is the dynamic compression cache config
+	//
+	// Compressed files are stored in Dir if it is set, and in memory otherwise.
+	// The cache evicts least recently used files to remain under MaxSize bytes.
+	CompressCacheConfig struct {
+		Dir     string
+		MaxSize int64
+	}
+
+	compressCache struct {
+		log     *klog.LevelLogger
+		dir     string
+		maxSize int64
+		mu      sync.Mutex
+		size    int64
+		entries map[string]*list.Element
+		lru     *list.List
+		flights map[string]*compressFlight
+	}
+
+	compressEntry struct {
+		key  string
+		size int64
+		data []byte
+		file string
+	}
+
+	compressFlight struct {
+		done chan struct{}
+		data []byte
+		err  error
+	}
+
+	compressedBody struct {
+		r     io.ReadSeeker
+		close func() error
+	}
+)
+
+const (
+	compressCacheFilePrefix = "fsserve-compress-"
+
+	defaultCompressMaxSize = 8 * 1024 * 1024
+
+	// brotliLevel is a moderate brotli quality since the highest qualities are
+	// too slow to compress files while a request waits
+	brotliLevel = 5
+)
+
+var compressEncoders = map[string]func(w io.Writer) (io.WriteCloser, error){
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	},
+	"zstd": func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+	},
+	"br": func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriterLevel(w, brotliLevel), nil
+	},
+}
+
+var defaultCompressContentTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func parseCompression(c *Compression, prefix string) error {
+	for _, i := range c.Codes {
+		if _, ok := compressEncoders[i]; !ok {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Unsupported compression code %s for route %s", i, prefix))
+		}
+	}
+	if c.MinSize < 0 {
+		return kerrors.WithMsg(nil, fmt.Sprintf("Invalid compression min size for route %s", prefix))
+	}
+	if c.MaxSize < 0 {
+		return kerrors.WithMsg(nil, fmt.Sprintf("Invalid compression max size for route %s", prefix))
+	}
+	c.maxSize = c.MaxSize
+	if c.maxSize == 0 {
+		c.maxSize = defaultCompressMaxSize
+	}
+	return nil
+}
+
+// limitCompressSize limits the size of dynamically compressed files to the
+// compression cache max size if the cache is enabled, since compressed files
+// which do not fit in the cache would otherwise be compressed on every request
+func limitCompressSize(c *Compression, cacheMaxSize int64) {
+	if cacheMaxSize > 0 {
+		c.maxSize = min(c.maxSize, cacheMaxSize)
+	}
+}
+
+func matchContentType(ctype string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	for _, i := range patterns {
+		if prefix, ok := strings.CutSuffix(i, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == i {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible returns if a file may be dynamically compressed
+func compressible(c Compression, ctype string, size int64) bool {
+	if len(c.Codes) == 0 || size < c.MinSize || size > c.maxSize {
+		return false
+	}
+	contentTypes := c.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = defaultCompressContentTypes
+	}
+	return matchContentType(ctype, contentTypes)
+}
+
+func compressFile(dir fs.FS, cfg fileConfig) (_ []byte, retErr error) {
+	newEncoder, ok := compressEncoders[cfg.encoding]
+	if !ok {
+		return nil, kerrors.WithMsg(nil, fmt.Sprintf("Unsupported compression code %s", cfg.encoding))
+	}
+	f, err := dir.Open(cfg.path)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to open file %s", cfg.path))
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			retErr = errors.Join(retErr, kerrors.WithMsg(err, fmt.Sprintf("Failed to close open file %s", cfg.path)))
+		}
+	}()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", cfg.path))
+	}
+	if cfg.tag != "" && statToTag(stat) != cfg.tag {
+		return nil, kerrors.WithMsg(nil, fmt.Sprintf("File changed while handling %s", cfg.path))
+	}
+	var b bytes.Buffer
+	w, err := newEncoder(&b)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to create %s encoder", cfg.encoding))
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to compress file %s", cfg.path))
+	}
+	if err := w.Close(); err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to compress file %s", cfg.path))
+	}
+	return b.Bytes(), nil
+}
+
+func newCompressCache(log *klog.LevelLogger, config CompressCacheConfig) *compressCache {
+	c := &compressCache{
+		log:     log,
+		dir:     config.Dir,
+		maxSize: config.MaxSize,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		flights: map[string]*compressFlight{},
+	}
+	if c.dir != "" {
+		c.removeStaleFiles()
+	}
+	return c
+}
+
+// removeStaleFiles removes cache files left by a previous server process
+func (c *compressCache) removeStaleFiles() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		c.log.Err(context.Background(), kerrors.WithMsg(err, fmt.Sprintf("Failed to read compression cache dir %s", c.dir)))
+		return
+	}
+	for _, i := range entries {
+		if i.IsDir() || !strings.HasPrefix(i.Name(), compressCacheFilePrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, i.Name())); err != nil {
+			c.log.Err(context.Background(), kerrors.WithMsg(err, fmt.Sprintf("Failed to remove stale compression cache file %s", i.Name())))
+		}
+	}
+}
+
+func compressCacheKey(prefix string, cfg fileConfig) string {
+	return cfg.encoding + ":" + prefix + ":" + cfg.path + ":" + cfg.tag
+}
+
+func (c *compressCache) cacheFileName(key string) string {
+	h := blake2b.Sum256([]byte(key))
+	return filepath.Join(c.dir, compressCacheFilePrefix+hex.EncodeToString(h[:]))
+}
+
+func (c *compressCache) openEntry(e *compressEntry) (*compressedBody, error) {
+	if e.file == "" {
+		return &compressedBody{
+			r:     bytes.NewReader(e.data),
+			close: func() error { return nil },
+		}, nil
+	}
+	// an open file may continue to be read after it is evicted and removed
+	f, err := os.Open(e.file)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to open compression cache file %s", e.file))
+	}
+	return &compressedBody{
+		r:     f,
+		close: f.Close,
+	}, nil
+}
+
+// get returns the cached compressed body for a key, and otherwise computes it.
+// Concurrent requests for the same key share a single computation.
+func (c *compressCache) get(ctx context.Context, key string, compute func() ([]byte, error)) (*compressedBody, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		e := el.Value.(*compressEntry)
+		c.mu.Unlock()
+		b, err := c.openEntry(e)
+		if err == nil {
+			return b, nil
+		}
+		c.log.Err(ctx, err)
+		c.mu.Lock()
+	}
+	if flight, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-flight.done:
+		case <-ctx.Done():
+			return nil, kerrors.WithMsg(context.Cause(ctx), "Context closed")
+		}
+		if flight.err != nil {
+			return nil, flight.err
+		}
+		return &compressedBody{
+			r:     bytes.NewReader(flight.data),
+			close: func() error { return nil },
+		}, nil
+	}
+	flight := &compressFlight{
+		done: make(chan struct{}),
+	}
+	c.flights[key] = flight
+	c.mu.Unlock()
+
+	flight.data, flight.err = compute()
+	if flight.err == nil {
+		c.store(ctx, key, flight.data)
+	}
+
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(flight.done)
+
+	if flight.err != nil {
+		return nil, flight.err
+	}
+	return &compressedBody{
+		r:     bytes.NewReader(flight.data),
+		close: func() error { return nil },
+	}, nil
+}
+
+func (c *compressCache) store(ctx context.Context, key string, data []byte) {
+	size := int64(len(data))
+	if size > c.maxSize {
+		return
+	}
+	e := &compressEntry{
+		key:  key,
+		size: size,
+	}
+	if c.dir != "" {
+		e.file = c.cacheFileName(key)
+		if err := writeFileAtomic(e.file, data); err != nil {
+			c.log.Err(ctx, err)
+			return
+		}
+	} else {
+		e.data = data
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		// the cache file of the previous entry has already been replaced
+		prev := c.lru.Remove(el).(*compressEntry)
+		delete(c.entries, key)
+		c.size -= prev.size
+	}
+	for c.size+size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			break
+		}
+		c.removeLocked(ctx, el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += size
+}
+
+func (c *compressCache) removeLocked(ctx context.Context, el *list.Element) {
+	e := c.lru.Remove(el).(*compressEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	if e.file != "" {
+		if err := os.Remove(e.file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.log.Err(ctx, kerrors.WithMsg(err, fmt.Sprintf("Failed to remove compression cache file %s", e.file)))
+		}
+	}
+}
+
+func writeFileAtomic(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return kerrors.WithMsg(err, "Failed to create compression cache file")
+	}
+	if _, err := f.Write(data); err != nil {
+		return errors.Join(kerrors.WithMsg(err, "Failed to write compression cache file"), f.Close(), os.Remove(f.Name()))
+	}
+	if err := f.Close(); err != nil {
+		return errors.Join(kerrors.WithMsg(err, "Failed to close compression cache file"), os.Remove(f.Name()))
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return errors.Join(kerrors.WithMsg(err, "Failed to rename compression cache file"), os.Remove(f.Name()))
+	}
+	return nil
+}
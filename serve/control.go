@@ -0,0 +1,254 @@
+package serve
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	// controlFiles are the rules of the _redirects and _headers files of a
+	// route
+	controlFiles struct {
+		redirects []controlRedirect
+		headers   []controlHeaders
+	}
+
+	controlRedirect struct {
+		rule  Rule
+		force bool
+	}
+
+	controlHeaders struct {
+		match   *regexp.Regexp
+		headers http.Header
+	}
+)
+
+const (
+	controlFileRedirects = "_redirects"
+	controlFileHeaders   = "_headers"
+)
+
+func isControlFile(name string) bool {
+	return name == controlFileRedirects || name == controlFileHeaders
+}
+
+var controlPlaceholderRegex = regexp.MustCompile(`:[A-Za-z_][A-Za-z0-9_]*`)
+
+// compileControlPattern compiles a path pattern with :name placeholders, which
+// match a single path segment, and a trailing * splat, which matches the rest
+// of the path
+func compileControlPattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	rest := pattern
+	splat := false
+	if s, ok := strings.CutSuffix(rest, "*"); ok {
+		rest = s
+		splat = true
+	}
+	last := 0
+	for _, m := range controlPlaceholderRegex.FindAllStringIndex(rest, -1) {
+		b.WriteString(regexp.QuoteMeta(rest[last:m[0]]))
+		b.WriteString("(?P<" + rest[m[0]+1:m[1]] + ">[^/]+)")
+		last = m[1]
+	}
+	b.WriteString(regexp.QuoteMeta(rest[last:]))
+	if splat {
+		b.WriteString("(?P<splat>.*)")
+	}
+	b.WriteString("$")
+	r, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid path pattern %s", pattern))
+	}
+	return r, nil
+}
+
+// expandControlTarget converts :name placeholders to regex expansion syntax
+func expandControlTarget(target string) string {
+	target = strings.ReplaceAll(target, "$", "$$")
+	return controlPlaceholderRegex.ReplaceAllStringFunc(target, func(s string) string {
+		return "${" + s[1:] + "}"
+	})
+}
+
+func parseControlRedirects(b []byte) ([]controlRedirect, error) {
+	var rules []controlRedirect
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid redirect rule on line %d", lineno))
+		}
+		from, to := fields[0], fields[1]
+		if !strings.HasPrefix(from, "/") {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid redirect path %s on line %d", from, lineno))
+		}
+		if !strings.HasPrefix(to, "/") && !strings.Contains(to, "://") {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid redirect target %s on line %d", to, lineno))
+		}
+		status := http.StatusMovedPermanently
+		force := false
+		if len(fields) == 3 {
+			s, ok := strings.CutSuffix(fields[2], "!")
+			force = ok
+			var err error
+			status, err = strconv.Atoi(s)
+			if err != nil {
+				return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid redirect status %s on line %d", fields[2], lineno))
+			}
+		}
+		if _, ok := redirectStatuses[status]; !ok && status != http.StatusOK {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Unsupported redirect status %d on line %d", status, lineno))
+		}
+		if status == http.StatusOK && !strings.HasPrefix(to, "/") {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Rewrite target %s must be a path on line %d", to, lineno))
+		}
+		match, err := compileControlPattern(from)
+		if err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid redirect rule on line %d", lineno))
+		}
+		rules = append(rules, controlRedirect{
+			rule: Rule{
+				Match:  ruleMatchRegex,
+				From:   match.String(),
+				To:     expandControlTarget(to),
+				Status: status,
+				regex:  match,
+			},
+			force: force,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read redirects")
+	}
+	return rules, nil
+}
+
+func parseControlHeaders(b []byte) ([]controlHeaders, error) {
+	var rules []controlHeaders
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if raw[0] != ' ' && raw[0] != '\t' {
+			if !strings.HasPrefix(line, "/") {
+				return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid headers path %s on line %d", line, lineno))
+			}
+			match, err := compileControlPattern(line)
+			if err != nil {
+				return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid headers rule on line %d", lineno))
+			}
+			rules = append(rules, controlHeaders{
+				match:   match,
+				headers: http.Header{},
+			})
+			continue
+		}
+		if len(rules) == 0 {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Header without a path on line %d", lineno))
+		}
+		k, v, ok := strings.Cut(line, ":")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid header on line %d", lineno))
+		}
+		rules[len(rules)-1].headers.Add(textproto.CanonicalMIMEHeaderKey(k), strings.TrimSpace(v))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, kerrors.WithMsg(err, "Failed to read headers")
+	}
+	return rules, nil
+}
+
+func readControlFile(dir fs.FS, name string) ([]byte, error) {
+	b, err := fs.ReadFile(dir, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read %s", name))
+	}
+	return b, nil
+}
+
+// loadControlFiles loads the _redirects and _headers files of a route dir
+func loadControlFiles(dir fs.FS) (*controlFiles, error) {
+	c := &controlFiles{}
+	b, err := readControlFile(dir, controlFileRedirects)
+	if err != nil {
+		return nil, err
+	}
+	c.redirects, err = parseControlRedirects(b)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid %s", controlFileRedirects))
+	}
+	b, err = readControlFile(dir, controlFileHeaders)
+	if err != nil {
+		return nil, err
+	}
+	c.headers, err = parseControlHeaders(b)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid %s", controlFileHeaders))
+	}
+	return c, nil
+}
+
+// matchRedirect returns the first redirect rule matching a path. Rules which
+// are not forced are shadowed by existing files.
+func (c *controlFiles) matchRedirect(dir fs.FS, p string, name string) (*Rule, string, error) {
+	for _, i := range c.redirects {
+		target, ok := i.rule.target(p)
+		if !ok {
+			continue
+		}
+		if !i.force {
+			if _, err := fs.Stat(dir, name); err == nil {
+				return nil, "", nil
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, "", kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", name))
+			}
+		}
+		return &i.rule, target, nil
+	}
+	return nil, "", nil
+}
+
+// matchHeaders returns the headers of all rules matching a path
+func (c *controlFiles) matchHeaders(p string) http.Header {
+	var headers http.Header
+	for _, i := range c.headers {
+		if !i.match.MatchString(p) {
+			continue
+		}
+		if headers == nil {
+			headers = http.Header{}
+		}
+		for k, v := range i.headers {
+			headers[k] = append(headers[k], v...)
+		}
+	}
+	return headers
+}
@@ -0,0 +1,161 @@
+package serve
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	// CORS is a route cross origin resource sharing policy
+	//
+	// Origins are allowed origins matched exactly, and may include * to allow
+	// all origins. OriginPatterns are allowed origin regexes. Credentials may
+	// not be allowed for all origins. MaxAge is the number of seconds a
+	// preflight response may be cached.
+	CORS struct {
+		Origins          []string `mapstructure:"origins"`
+		OriginPatterns   []string `mapstructure:"origin_patterns"`
+		AllowHeaders     []string `mapstructure:"allow_headers"`
+		ExposeHeaders    []string `mapstructure:"expose_headers"`
+		AllowCredentials bool     `mapstructure:"allow_credentials"`
+		MaxAge           int      `mapstructure:"max_age"`
+		originPatterns   []*regexp.Regexp
+	}
+)
+
+const (
+	headerAllow                         = "Allow"
+	headerOrigin                        = "Origin"
+	headerAccessControlAllowOrigin      = "Access-Control-Allow-Origin"
+	headerAccessControlAllowCredentials = "Access-Control-Allow-Credentials"
+	headerAccessControlAllowMethods     = "Access-Control-Allow-Methods"
+	headerAccessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	headerAccessControlExposeHeaders    = "Access-Control-Expose-Headers"
+	headerAccessControlMaxAge           = "Access-Control-Max-Age"
+	headerAccessControlRequestMethod    = "Access-Control-Request-Method"
+	headerAccessControlRequestHeaders   = "Access-Control-Request-Headers"
+
+	corsAllOrigins = "*"
+)
+
+var (
+	// allowMethods is the Allow header value of all routes
+	allowMethods = strings.Join([]string{http.MethodGet, http.MethodHead, http.MethodOptions}, ", ")
+	// corsAllowMethods are the methods allowed for cross origin requests
+	corsAllowMethods = strings.Join([]string{http.MethodGet, http.MethodHead}, ", ")
+)
+
+func (c CORS) enabled() bool {
+	return len(c.Origins) > 0 || len(c.OriginPatterns) > 0
+}
+
+func parseCORS(c *CORS, prefix string) error {
+	for _, i := range c.Origins {
+		if i == "" {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Empty cors origin for route %s", prefix))
+		}
+		if i == corsAllOrigins && c.AllowCredentials {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Cors credentials may not be allowed for all origins for route %s", prefix))
+		}
+	}
+	c.originPatterns = make([]*regexp.Regexp, 0, len(c.OriginPatterns))
+	for _, i := range c.OriginPatterns {
+		r, err := regexp.Compile(i)
+		if err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Invalid cors origin pattern %s for route %s", i, prefix))
+		}
+		c.originPatterns = append(c.originPatterns, r)
+	}
+	if c.MaxAge < 0 {
+		return kerrors.WithMsg(nil, fmt.Sprintf("Invalid cors max age for route %s", prefix))
+	}
+	return nil
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for an origin, and
+// false if the origin is not allowed
+func (c CORS) allowOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	if slices.Contains(c.Origins, corsAllOrigins) {
+		return corsAllOrigins, true
+	}
+	if slices.Contains(c.Origins, origin) {
+		return origin, true
+	}
+	for _, i := range c.originPatterns {
+		if i.MatchString(origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+func isPreflightRequest(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get(headerOrigin) != "" && r.Header.Get(headerAccessControlRequestMethod) != ""
+}
+
+// serveCORS writes the cors headers of a route, and returns true if the
+// request is fully handled as an OPTIONS request
+func serveCORS(w *errorPageWriter, r *http.Request, c CORS) bool {
+	if !c.enabled() {
+		if r.Method == http.MethodOptions {
+			w.Header().Set(headerAllow, allowMethods)
+			w.WriteHeader(http.StatusNoContent)
+			return true
+		}
+		return false
+	}
+
+	w.Header().Add(headerVary, headerOrigin)
+	// the response differs by origin regardless of the outcome of the request
+	w.vary = append(w.vary, headerOrigin)
+	origin, ok := c.allowOrigin(r.Header.Get(headerOrigin))
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set(headerAllow, allowMethods)
+		if !isPreflightRequest(r) {
+			w.WriteHeader(http.StatusNoContent)
+			return true
+		}
+		w.Header().Add(headerVary, headerAccessControlRequestMethod)
+		w.Header().Add(headerVary, headerAccessControlRequestHeaders)
+		method := r.Header.Get(headerAccessControlRequestMethod)
+		if !ok || (method != http.MethodGet && method != http.MethodHead) {
+			w.WriteHeader(http.StatusNoContent)
+			return true
+		}
+		w.Header().Set(headerAccessControlAllowOrigin, origin)
+		if c.AllowCredentials {
+			w.Header().Set(headerAccessControlAllowCredentials, "true")
+		}
+		w.Header().Set(headerAccessControlAllowMethods, corsAllowMethods)
+		if len(c.AllowHeaders) > 0 {
+			w.Header().Set(headerAccessControlAllowHeaders, strings.Join(c.AllowHeaders, ", "))
+		}
+		if c.MaxAge > 0 {
+			w.Header().Set(headerAccessControlMaxAge, strconv.Itoa(c.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+
+	if !ok {
+		return false
+	}
+	w.Header().Set(headerAccessControlAllowOrigin, origin)
+	if c.AllowCredentials {
+		w.Header().Set(headerAccessControlAllowCredentials, "true")
+	}
+	if len(c.ExposeHeaders) > 0 {
+		w.Header().Set(headerAccessControlExposeHeaders, strings.Join(c.ExposeHeaders, ", "))
+	}
+	return false
+}
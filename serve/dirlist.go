@@ -0,0 +1,527 @@
+package serve
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"xorkevin.dev/fsserve/util/kjson"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/kfs"
+	"xorkevin.dev/klog"
+)
+
+type (
+	resDirEntry struct {
+		Name        string    `json:"name"`
+		Dir         bool      `json:"dir,omitempty"`
+		Size        int64     `json:"size"`
+		ModTime     time.Time `json:"mod_time"`
+		ContentType string    `json:"content_type,omitempty"`
+		Checksum    string    `json:"checksum,omitempty"`
+		Encodings   []string  `json:"encodings,omitempty"`
+		info        fs.FileInfo
+	}
+
+	resDirListing struct {
+		Entries []resDirEntry `json:"entries"`
+		Next    string        `json:"next,omitempty"`
+	}
+
+	dirListCursor struct {
+		Name    string    `json:"name"`
+		Size    int64     `json:"size"`
+		ModTime time.Time `json:"mod_time"`
+	}
+
+	dirListTemplateEntry struct {
+		resDirEntry
+		URL string
+	}
+
+	dirListTemplateData struct {
+		Path    string
+		Parent  string
+		Sort    string
+		Order   string
+		Next    string
+		Entries []dirListTemplateEntry
+	}
+)
+
+const (
+	dirListSortName = "name"
+	dirListSortSize = "size"
+	dirListSortTime = "time"
+
+	dirListOrderAsc  = "asc"
+	dirListOrderDesc = "desc"
+
+	dirListCacheControl = "no-cache"
+
+	mediaTypeHTML = "text/html"
+	mediaTypeJSON = "application/json"
+)
+
+const defaultDirListTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<thead>
+<tr>
+<th><a href="?dir=t&amp;sort=name&amp;order={{if and (eq .Sort "name") (eq .Order "asc")}}desc{{else}}asc{{end}}">Name</a></th>
+<th><a href="?dir=t&amp;sort=size&amp;order={{if and (eq .Sort "size") (eq .Order "asc")}}desc{{else}}asc{{end}}">Size</a></th>
+<th><a href="?dir=t&amp;sort=time&amp;order={{if and (eq .Sort "time") (eq .Order "asc")}}desc{{else}}asc{{end}}">Modified</a></th>
+<th>Type</th>
+</tr>
+</thead>
+<tbody>
+{{- if .Parent}}
+<tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr>
+<td><a href="{{.URL}}">{{.Name}}{{if .Dir}}/{{end}}</a></td>
+<td>{{if not .Dir}}{{.Size}}{{end}}</td>
+<td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.ContentType}}</td>
+</tr>
+{{- end}}
+</tbody>
+</table>
+{{- if .Next}}
+<p><a href="{{.Next}}">Next</a></p>
+{{- end}}
+</body>
+</html>
+`
+
+var defaultDirListTmpl = template.Must(template.New("dirlist").Parse(defaultDirListTemplate))
+
+func parseDirListTemplate(file string) (*template.Template, error) {
+	t, err := template.New(filepath.Base(file)).ParseFiles(file)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to parse dir list template %s", file))
+	}
+	return t, nil
+}
+
+func compareDirEntries(a, b resDirEntry, key string, order string) int {
+	var c int
+	switch key {
+	case dirListSortSize:
+		c = cmp.Compare(a.Size, b.Size)
+	case dirListSortTime:
+		c = a.ModTime.Compare(b.ModTime)
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if order == dirListOrderDesc {
+		return -c
+	}
+	return c
+}
+
+func sortDirEntries(entries []resDirEntry, key string, order string) {
+	slices.SortFunc(entries, func(a, b resDirEntry) int {
+		return compareDirEntries(a, b, key, order)
+	})
+}
+
+// encodeDirListCursor encodes the sort keys of an entry as an opaque cursor.
+// Entries are uniquely ordered by name, so the cursor remains valid when other
+// entries are added or removed.
+func encodeDirListCursor(e resDirEntry) (string, error) {
+	b, err := kjson.Marshal(dirListCursor{
+		Name:    e.Name,
+		Size:    e.Size,
+		ModTime: e.ModTime,
+	})
+	if err != nil {
+		return "", kerrors.WithMsg(err, "Failed to encode dir list cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeDirListCursor(s string) (*resDirEntry, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, kerrors.WithKind(err, ErrInvalidReq, "Invalid dir list cursor")
+	}
+	var c dirListCursor
+	if err := kjson.Unmarshal(b, &c); err != nil {
+		return nil, kerrors.WithKind(err, ErrInvalidReq, "Invalid dir list cursor")
+	}
+	return &resDirEntry{
+		Name:    c.Name,
+		Size:    c.Size,
+		ModTime: c.ModTime,
+	}, nil
+}
+
+func parseDirListInt(query url.Values, key string) (int, error) {
+	s := query.Get(key)
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		return 0, kerrors.WithKind(err, ErrInvalidReq, fmt.Sprintf("Invalid dir list %s: %s", key, s))
+	}
+	return v, nil
+}
+
+// hideEncodedEntries removes the precompressed encodings of files from the
+// entries of a single dir, and instead lists the available encoding codes on
+// the file entry
+func hideEncodedEntries(route Route, dirName string, entries []resDirEntry) []resDirEntry {
+	files := map[string]int{}
+	for n, i := range entries {
+		if !i.Dir {
+			files[i.Name] = n
+		}
+	}
+	hidden := map[int]struct{}{}
+	for _, i := range route.Encodings {
+		for n, j := range entries {
+			if j.Dir {
+				continue
+			}
+			base, ok := strings.CutSuffix(j.Name, i.Ext)
+			if !ok {
+				continue
+			}
+			m, ok := files[base]
+			if !ok {
+				continue
+			}
+			if i.match != nil {
+				if !i.match.MatchString(path.Join(dirName, base)) {
+					continue
+				}
+			}
+			hidden[n] = struct{}{}
+			entries[m].Encodings = append(entries[m].Encodings, i.Code)
+		}
+	}
+	if len(hidden) == 0 {
+		return entries
+	}
+	res := make([]resDirEntry, 0, len(entries)-len(hidden))
+	for n, i := range entries {
+		if _, ok := hidden[n]; ok {
+			continue
+		}
+		res = append(res, i)
+	}
+	return res
+}
+
+// readDirEntries appends the entries of a dir to listing, with names relative
+// to the listed dir. Dirs are descended until depth reaches 1 unless excluded
+// by the route, and entries are filtered by [routeMatchPath]. Only the sort
+// keys of entries are read, and the remaining details are filled in by
+// [fillDirEntryDetails] once the listing is paginated.
+func readDirEntries(ctx context.Context, log *klog.LevelLogger, dir fs.FS, route Route, dirName string, rel string, depth int, listing []resDirEntry) ([]resDirEntry, error) {
+	p := path.Join(dirName, rel)
+	entries, err := fs.ReadDir(dir, p)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read dir: %s", p))
+	}
+	var dirEntries []resDirEntry
+	for _, i := range entries {
+		name := path.Join(rel, i.Name())
+		fp := path.Join(dirName, name)
+		isDir := i.IsDir()
+		if route.ControlFiles && !isDir && isControlFile(fp) {
+			continue
+		}
+		if isDir && depth > 1 && (route.exclude == nil || !route.exclude.MatchString(fp)) {
+			var err error
+			listing, err = readDirEntries(ctx, log, dir, route, dirName, name, depth-1, listing)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !routeMatchPath(route, fp) {
+			continue
+		}
+		info, err := i.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// file removed after reading dir
+				continue
+			}
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", fp))
+		}
+		entry := resDirEntry{
+			Name:    name,
+			Dir:     isDir,
+			ModTime: info.ModTime().UTC(),
+			info:    info,
+		}
+		if !isDir {
+			entry.Size = info.Size()
+		}
+		dirEntries = append(dirEntries, entry)
+	}
+	if route.HideEncoded {
+		dirEntries = hideEncodedEntries(route, dirName, dirEntries)
+	}
+	return append(listing, dirEntries...), nil
+}
+
+// fillDirEntryDetails fills in the content type and checksum of file entries
+func fillDirEntryDetails(ctx context.Context, log *klog.LevelLogger, dir fs.FS, route Route, dirName string, listing []resDirEntry) {
+	for n, i := range listing {
+		if i.Dir {
+			continue
+		}
+		listing[n].ContentType = detectContentType(i.Name, route.DefaultContentType)
+		listing[n].Checksum = readDirEntryChecksum(ctx, log, dir, route, path.Join(dirName, i.Name), i.info)
+	}
+}
+
+func dirListURL(route Route, name string, isDir bool) string {
+	p := route.Prefix
+	if name != "." {
+		p = path.Join(p, name)
+	}
+	u := url.URL{Path: p}
+	if isDir {
+		u.RawQuery = "dir=t"
+	}
+	return u.String()
+}
+
+// readDirEntryChecksum returns the stored checksum of a file if it is current
+func readDirEntryChecksum(ctx context.Context, log *klog.LevelLogger, dir fs.FS, route Route, p string, stat fs.FileInfo) string {
+	if route.DisableXAttr {
+		return ""
+	}
+	fullFilePath, err := kfs.FullFilePath(dir, p)
+	if err != nil {
+		log.Err(ctx, kerrors.WithMsg(err, "Failed to get full file path for file"),
+			klog.AString("path", p),
+		)
+		return ""
+	}
+	xattrChecksum := route.XAttrChecksum
+	if xattrChecksum == "" {
+		xattrChecksum = defaultXAttrChecksum
+	}
+	hash, tag, err := readChecksumXAttr(xattrChecksum, fullFilePath)
+	if err != nil {
+		log.Err(ctx, err, klog.AString("path", p))
+		return ""
+	}
+	if tag != statToTag(stat) {
+		return ""
+	}
+	return hash
+}
+
+func serveDir(
+	log *klog.LevelLogger,
+	dir fs.FS,
+	w http.ResponseWriter,
+	r *http.Request,
+	dirName string,
+	route Route,
+) {
+	ctx := r.Context()
+
+	if !route.DirList {
+		writeError(ctx, log, w, kerrors.WithKind(nil, ErrInvalidReq, "Dir listing not supported"))
+		return
+	}
+
+	if dirName == "" {
+		dirName = "."
+	}
+
+	query := r.URL.Query()
+	sortKey := query.Get("sort")
+	switch sortKey {
+	case "":
+		sortKey = dirListSortName
+	case dirListSortName, dirListSortSize, dirListSortTime:
+	default:
+		writeError(ctx, log, w, kerrors.WithKind(nil, ErrInvalidReq, fmt.Sprintf("Invalid dir list sort: %s", sortKey)))
+		return
+	}
+	order := query.Get("order")
+	switch order {
+	case "":
+		order = dirListOrderAsc
+	case dirListOrderAsc, dirListOrderDesc:
+	default:
+		writeError(ctx, log, w, kerrors.WithKind(nil, ErrInvalidReq, fmt.Sprintf("Invalid dir list order: %s", order)))
+		return
+	}
+
+	depth := 1
+	if query.Get("recursive") == "t" {
+		if route.DirListMaxDepth < 1 {
+			writeError(ctx, log, w, kerrors.WithKind(nil, ErrInvalidReq, "Recursive dir listing not supported"))
+			return
+		}
+		depth = route.DirListMaxDepth
+		if d, err := parseDirListInt(query, "depth"); err != nil {
+			writeError(ctx, log, w, err)
+			return
+		} else if d > 0 {
+			if d > route.DirListMaxDepth {
+				writeError(ctx, log, w, kerrors.WithKind(nil, ErrInvalidReq, fmt.Sprintf("Dir list depth exceeds max of %d", route.DirListMaxDepth)))
+				return
+			}
+			depth = d
+		}
+	}
+	limit, err := parseDirListInt(query, "limit")
+	if err != nil {
+		writeError(ctx, log, w, err)
+		return
+	}
+	if route.DirListLimit > 0 && (limit == 0 || limit > route.DirListLimit) {
+		limit = route.DirListLimit
+	}
+	var after *resDirEntry
+	if s := query.Get("after"); s != "" {
+		var err error
+		after, err = decodeDirListCursor(s)
+		if err != nil {
+			writeError(ctx, log, w, err)
+			return
+		}
+	}
+
+	stat, err := fs.Stat(dir, dirName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(ctx, log, w, kerrors.WithKind(err, ErrNotFound, fmt.Sprintf("Dir not found: %s", dirName)))
+			return
+		}
+		writeError(ctx, log, w, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat dir %s", dirName)))
+		return
+	}
+	if !stat.IsDir() {
+		writeError(ctx, log, w, kerrors.WithKind(nil, ErrInvalidReq, fmt.Sprintf("Path %s is not a directory", dirName)))
+		return
+	}
+
+	listing, err := readDirEntries(ctx, log, dir, route, dirName, "", depth, []resDirEntry{})
+	if err != nil {
+		writeError(ctx, log, w, err)
+		return
+	}
+	sortDirEntries(listing, sortKey, order)
+	if after != nil {
+		start, _ := slices.BinarySearchFunc(listing, *after, func(a, b resDirEntry) int {
+			return compareDirEntries(a, b, sortKey, order)
+		})
+		if start < len(listing) && compareDirEntries(listing[start], *after, sortKey, order) == 0 {
+			start++
+		}
+		listing = listing[start:]
+	}
+	var next string
+	if limit > 0 && len(listing) > limit {
+		listing = listing[:limit]
+		var err error
+		next, err = encodeDirListCursor(listing[limit-1])
+		if err != nil {
+			writeError(ctx, log, w, err)
+			return
+		}
+	}
+	fillDirEntryDetails(ctx, log, dir, route, dirName, listing)
+
+	accept := parseAcceptMediaTypes(r.Header)
+	isHTML := accept.weight(mediaTypeHTML) > accept.weight(mediaTypeJSON)
+
+	var b []byte
+	var ctype string
+	if isHTML {
+		tmpl := route.dirListTemplate
+		if tmpl == nil {
+			tmpl = defaultDirListTmpl
+		}
+		data := dirListTemplateData{
+			Path:    path.Join("/", route.Prefix, dirName),
+			Sort:    sortKey,
+			Order:   order,
+			Entries: make([]dirListTemplateEntry, 0, len(listing)),
+		}
+		if dirName != "." {
+			data.Parent = dirListURL(route, path.Dir(dirName), true)
+		}
+		if next != "" {
+			q := r.URL.Query()
+			q.Set("after", next)
+			data.Next = "?" + q.Encode()
+		}
+		for _, i := range listing {
+			data.Entries = append(data.Entries, dirListTemplateEntry{
+				resDirEntry: i,
+				URL:         dirListURL(route, path.Join(dirName, i.Name), i.Dir),
+			})
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			writeError(ctx, log, w, kerrors.WithMsg(err, fmt.Sprintf("Failed to render dir listing: %s", dirName)))
+			return
+		}
+		b = buf.Bytes()
+		ctype = mediaTypeHTML + "; charset=utf-8"
+	} else {
+		var err error
+		b, err = kjson.Marshal(resDirListing{
+			Entries: listing,
+			Next:    next,
+		})
+		if err != nil {
+			writeError(ctx, log, w, kerrors.WithMsg(err, fmt.Sprintf("Failed to encode dir listing: %s", dirName)))
+			return
+		}
+		ctype = mediaTypeJSON
+	}
+
+	w.Header().Add(headerVary, headerAccept)
+	w.Header().Set(headerCacheControl, dirListCacheControl)
+	h := blake2b.Sum256(b)
+	etag := calcWeakETag(base64.RawURLEncoding.EncodeToString(h[:]))
+	w.Header().Set(headerETag, etag)
+	if _, ok := matchIfNoneMatch(r.Header, etag); ok {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set(headerContentType, ctype)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		log.Err(ctx, kerrors.WithMsg(err, fmt.Sprintf("Failed writing http res for dir: %s", dirName)))
+		return
+	}
+}
@@ -0,0 +1,195 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+
+	"xorkevin.dev/fsserve/util/kjson"
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+type (
+	// ErrorPages is the default error page config for all routes
+	//
+	// Pages maps status codes to files relative to the server root which are
+	// served as the body of error responses. Encodings are the precompressed
+	// encodings of the files. ProblemJSON serves RFC 9457 problem details
+	// instead of pages.
+	ErrorPages struct {
+		Pages       map[string]string `mapstructure:"pages"`
+		Encodings   []Encoding        `mapstructure:"encodings"`
+		ProblemJSON bool              `mapstructure:"problem_json"`
+	}
+
+	// errorPageSet is the error pages of a route, followed by the defaults
+	errorPageSet struct {
+		dir   fs.FS
+		route Route
+		next  *errorPageSet
+	}
+
+	errorPageWriter struct {
+		http.ResponseWriter
+		r          *http.Request
+		pages      *errorPageSet
+		resHeaders []string
+		vary       []string
+	}
+
+	resProblem struct {
+		Type   string `json:"type"`
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		LReqID string `json:"lreqid,omitempty"`
+	}
+
+	ctxKeyLReqID struct{}
+)
+
+const (
+	mediaTypeProblemJSON = "application/problem+json"
+
+	headerXContentTypeOptions = "X-Content-Type-Options"
+)
+
+func parseErrorPages(pages map[string]string) (map[int]string, error) {
+	if len(pages) == 0 {
+		return nil, nil
+	}
+	res := make(map[int]string, len(pages))
+	for k, v := range pages {
+		status, err := strconv.Atoi(k)
+		if err != nil || status < http.StatusBadRequest || status > 599 {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid error page status %s", k))
+		}
+		if !fs.ValidPath(v) {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid error page file %s", v))
+		}
+		res[status] = v
+	}
+	return res, nil
+}
+
+func newDefaultErrorPages(dir fs.FS, config ErrorPages) (*errorPageSet, error) {
+	routes := []Route{
+		{
+			Path:        ".",
+			Encodings:   config.Encodings,
+			ErrorPages:  config.Pages,
+			ProblemJSON: config.ProblemJSON,
+		},
+	}
+	if err := parseRoutes(routes); err != nil {
+		return nil, kerrors.WithMsg(err, "Invalid error pages")
+	}
+	return &errorPageSet{
+		dir:   dir,
+		route: routes[0],
+	}, nil
+}
+
+func (p *errorPageSet) wrap(w http.ResponseWriter, r *http.Request) *errorPageWriter {
+	return &errorPageWriter{
+		ResponseWriter: w,
+		r:              r,
+		pages:          p,
+	}
+}
+
+func (w *errorPageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func getCtxLReqID(ctx context.Context) string {
+	v, _ := ctx.Value(ctxKeyLReqID{}).(string)
+	return v
+}
+
+// writeError writes the body of an error response, and falls back to a plain
+// text body if no error page is available. Route error pages take precedence
+// over the defaults.
+func (w *errorPageWriter) writeError(ctx context.Context, log *klog.LevelLogger, status int) {
+	for i := w.pages; i != nil; i = i.next {
+		if i.route.ProblemJSON {
+			w.writeProblem(ctx, log, status)
+			return
+		}
+		page, ok := i.route.errorPages[status]
+		if !ok {
+			continue
+		}
+		if err := w.writePage(ctx, log, i, page, status); err != nil {
+			log.Err(ctx, kerrors.WithMsg(err, "Failed to serve error page"),
+				klog.AString("path", page),
+			)
+			continue
+		}
+		return
+	}
+	http.Error(w.ResponseWriter, http.StatusText(status), status)
+}
+
+func (w *errorPageWriter) writeProblem(ctx context.Context, log *klog.LevelLogger, status int) {
+	b, err := kjson.Marshal(resProblem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		LReqID: getCtxLReqID(ctx),
+	})
+	if err != nil {
+		log.Err(ctx, kerrors.WithMsg(err, "Failed to encode problem details"))
+		http.Error(w.ResponseWriter, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set(headerContentType, mediaTypeProblemJSON)
+	w.Header().Set(headerXContentTypeOptions, "nosniff")
+	w.WriteHeader(status)
+	if _, err := w.Write(b); err != nil {
+		log.Err(ctx, kerrors.WithMsg(err, "Failed writing problem details"))
+	}
+}
+
+func (w *errorPageWriter) writePage(ctx context.Context, log *klog.LevelLogger, pages *errorPageSet, page string, status int) error {
+	route := pages.route
+	// error pages are only served with precompressed encodings
+	route.Compress = Compression{}
+	cfg, err := getFileConfig(ctx, log, pages.dir, w.r, page, route)
+	if err != nil {
+		return err
+	}
+	f, err := pages.dir.Open(cfg.path)
+	if err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Failed to open file %s", cfg.path))
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Err(ctx, kerrors.WithMsg(err, fmt.Sprintf("Failed to close open file %s", cfg.path)))
+		}
+	}()
+
+	w.Header().Add(headerVary, headerAcceptEncoding)
+	for _, i := range cfg.vary {
+		w.Header().Add(headerVary, i)
+	}
+	if cfg.encoding != "" {
+		w.Header().Set(headerContentEncoding, cfg.encoding)
+	}
+	if cfg.language != "" {
+		w.Header().Set(headerContentLanguage, cfg.language)
+	}
+	w.Header().Set(headerContentType, cfg.ctype)
+	w.Header().Set(headerXContentTypeOptions, "nosniff")
+	w.WriteHeader(status)
+	if w.r.Method == http.MethodHead {
+		return nil
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		log.Err(ctx, kerrors.WithMsg(err, fmt.Sprintf("Failed writing error page %s", cfg.path)))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package serve
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"xorkevin.dev/fsserve/util/kjson"
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	// BuildInfo is the server build info reported by the version endpoint
+	BuildInfo struct {
+		Version   string    `json:"version"`
+		VCS       string    `json:"vcs"`
+		VCSTime   time.Time `json:"vcs_time"`
+		GoVersion string    `json:"go_version"`
+	}
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+	versionPath = "/version"
+
+	mediaTypeTextPlain = "text/plain; charset=utf-8"
+)
+
+// checkReady returns an error if the server is not ready to serve requests
+func (s *Server) checkReady() error {
+	if s.draining.Load() {
+		return kerrors.WithMsg(nil, "Server is shutting down")
+	}
+	if !s.mounted.Load() {
+		return kerrors.WithMsg(nil, "Routes are not mounted")
+	}
+	for _, i := range s.state.Load().routes {
+		if _, err := fs.Stat(s.dir, i.Path); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Failed to stat path %s of route %s", i.Path, i.Prefix))
+		}
+	}
+	return nil
+}
+
+func writeProbeText(w http.ResponseWriter, r *http.Request, status int, text string) {
+	w.Header().Set(headerContentType, mediaTypeTextPlain)
+	w.Header().Set(headerCacheControl, "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write([]byte(text + "\n"))
+	}
+}
+
+// serveProbe serves the health, readiness, and version endpoints. Probes are
+// served only on the admin listeners so that they do not shadow routes and the
+// build info is not public.
+func (s *Server) serveProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set(headerAllow, "GET, HEAD")
+		writeProbeText(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	switch r.URL.Path {
+	case healthzPath:
+		writeProbeText(w, r, http.StatusOK, "ok")
+	case readyzPath:
+		if err := s.checkReady(); err != nil {
+			s.log.WarnErr(r.Context(), kerrors.WithMsg(err, "Server not ready"))
+			writeProbeText(w, r, http.StatusServiceUnavailable, "not ready")
+			return
+		}
+		writeProbeText(w, r, http.StatusOK, "ok")
+	case versionPath:
+		b, err := kjson.Marshal(s.config.BuildInfo)
+		if err != nil {
+			s.log.Err(r.Context(), kerrors.WithMsg(err, "Failed to marshal build info"))
+			writeProbeText(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		w.Header().Set(headerContentType, mediaTypeJSON)
+		w.Header().Set(headerCacheControl, "no-store")
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(b)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package serve
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+type (
+	// IPFilter restricts requests by the real client ip
+	//
+	// Allow and Deny are ip prefixes. If Allow is set, only ips in Allow are
+	// permitted. Deny takes precedence over Allow.
+	IPFilter struct {
+		Allow []string `mapstructure:"allow"`
+		Deny  []string `mapstructure:"deny"`
+		allow []netip.Prefix
+		deny  []netip.Prefix
+	}
+)
+
+func (f IPFilter) enabled() bool {
+	return len(f.Allow) > 0 || len(f.Deny) > 0
+}
+
+func parsePrefixes(prefixes []string) ([]netip.Prefix, error) {
+	res := make([]netip.Prefix, 0, len(prefixes))
+	for _, i := range prefixes {
+		k, err := netip.ParsePrefix(i)
+		if err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid CIDR %s", i))
+		}
+		res = append(res, k)
+	}
+	return res, nil
+}
+
+func parseIPFilter(f *IPFilter, scope string) error {
+	var err error
+	f.allow, err = parsePrefixes(f.Allow)
+	if err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Invalid ip filter allow list for %s", scope))
+	}
+	f.deny, err = parsePrefixes(f.Deny)
+	if err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Invalid ip filter deny list for %s", scope))
+	}
+	return nil
+}
+
+// permit returns if an ip is permitted and the reason for the decision
+func (f IPFilter) permit(ip netip.Addr) (bool, string) {
+	if !ip.IsValid() {
+		if len(f.allow) > 0 {
+			return false, "unknown"
+		}
+		return true, "unknown"
+	}
+	if ipnetsContain(ip, f.deny) {
+		return false, "deny"
+	}
+	if len(f.allow) > 0 {
+		if ipnetsContain(ip, f.allow) {
+			return true, "allow"
+		}
+		return false, "not_allowed"
+	}
+	return true, "default"
+}
+
+// checkIPFilter returns an error if the real ip of a request is not permitted
+// by the filter of a route, or the global filter if prefix is empty
+func checkIPFilter(log *klog.LevelLogger, r *http.Request, prefix string, f IPFilter) error {
+	if !f.enabled() {
+		return nil
+	}
+	ctx := r.Context()
+	ok, reason := f.permit(getCtxRealIP(ctx))
+	attrs := []klog.Attr{
+		klog.AString("route.prefix", prefix),
+		klog.ABool("ipfilter.permit", ok),
+		klog.AString("ipfilter.reason", reason),
+	}
+	if !ok {
+		log.Warn(ctx, "IP filter denied request", attrs...)
+		if prefix == "" {
+			return kerrors.WithKind(nil, ErrForbidden, "IP not permitted")
+		}
+		return kerrors.WithKind(nil, ErrForbidden, fmt.Sprintf("IP not permitted for route %s", prefix))
+	}
+	log.Debug(ctx, "IP filter permitted request", attrs...)
+	return nil
+}
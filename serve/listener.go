@@ -0,0 +1,282 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	// Listener is a server listener config
+	//
+	// Network may be one of tcp, unix, or systemd. For tcp, Addr is a host:port
+	// pair. For unix, Addr is the socket path, and Mode, Owner, and Group
+	// optionally set the permissions of the socket file. For systemd, Addr is
+	// the name of the inherited socket from LISTEN_FDNAMES, and an empty Addr
+	// selects all inherited sockets. Peers of unix sockets are trusted proxies,
+	// and the real ip of their requests is read from X-Forwarded-For.
+	Listener struct {
+		Network string `mapstructure:"network"`
+		Addr    string `mapstructure:"addr"`
+		Mode    string `mapstructure:"mode"`
+		Owner   string `mapstructure:"owner"`
+		Group   string `mapstructure:"group"`
+		TLS     bool   `mapstructure:"tls"`
+	}
+
+	boundListener struct {
+		l   net.Listener
+		cfg Listener
+	}
+)
+
+const (
+	listenerNetworkTCP     = "tcp"
+	listenerNetworkUnix    = "unix"
+	listenerNetworkSystemd = "systemd"
+)
+
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+
+	// sdListenFDsStart is the first file descriptor passed by systemd
+	sdListenFDsStart = 3
+)
+
+type (
+	systemdFD struct {
+		name string
+		l    net.Listener
+	}
+)
+
+// listenSystemd returns the sockets passed by systemd socket activation
+func listenSystemd() ([]systemdFD, error) {
+	pidstr := os.Getenv(envListenPID)
+	if pidstr == "" {
+		return nil, nil
+	}
+	pid, err := strconv.Atoi(pidstr)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid %s", envListenPID))
+	}
+	if pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || count < 0 {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid %s", envListenFDs))
+	}
+	var names []string
+	if s := os.Getenv(envListenFDNames); s != "" {
+		names = strings.Split(s, ":")
+	}
+	// prevent sockets from being inherited again by child processes
+	os.Unsetenv(envListenPID)
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenFDNames)
+
+	fds := make([]systemdFD, 0, count)
+	for i := 0; i < count; i++ {
+		fd := sdListenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), "systemd-"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// net.FileListener dups the file descriptor
+		if err := f.Close(); err != nil {
+			return nil, errors.Join(closeSystemdFDs(fds), kerrors.WithMsg(err, fmt.Sprintf("Failed to close systemd socket fd %d", fd)))
+		}
+		if err != nil {
+			return nil, errors.Join(closeSystemdFDs(fds), kerrors.WithMsg(err, fmt.Sprintf("Failed to listen on systemd socket fd %d", fd)))
+		}
+		fds = append(fds, systemdFD{
+			name: name,
+			l:    l,
+		})
+	}
+	return fds, nil
+}
+
+func closeSystemdFDs(fds []systemdFD) error {
+	var errs []error
+	for _, i := range fds {
+		if i.l == nil {
+			continue
+		}
+		if err := i.l.Close(); err != nil {
+			errs = append(errs, kerrors.WithMsg(err, fmt.Sprintf("Failed to close systemd socket %s", i.name)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parseFileMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, kerrors.WithMsg(err, fmt.Sprintf("Invalid file mode %s", s))
+	}
+	return os.FileMode(m) & os.ModePerm, nil
+}
+
+func lookupUID(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, kerrors.WithMsg(err, fmt.Sprintf("Failed to lookup user %s", s))
+	}
+	id, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, kerrors.WithMsg(err, fmt.Sprintf("Invalid uid for user %s", s))
+	}
+	return id, nil
+}
+
+func lookupGID(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, kerrors.WithMsg(err, fmt.Sprintf("Failed to lookup group %s", s))
+	}
+	id, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, kerrors.WithMsg(err, fmt.Sprintf("Invalid gid for group %s", s))
+	}
+	return id, nil
+}
+
+func listenUnix(cfg Listener) (net.Listener, error) {
+	if cfg.Addr == "" {
+		return nil, kerrors.WithMsg(nil, "Missing unix socket path")
+	}
+	// remove a stale socket left behind by an unclean shutdown
+	if stat, err := os.Lstat(cfg.Addr); err == nil {
+		if stat.Mode().Type() != os.ModeSocket {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("File %s exists and is not a socket", cfg.Addr))
+		}
+		if err := os.Remove(cfg.Addr); err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to remove stale socket %s", cfg.Addr))
+		}
+	}
+	l, err := net.Listen(listenerNetworkUnix, cfg.Addr)
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to listen on unix socket %s", cfg.Addr))
+	}
+	if cfg.Mode != "" {
+		mode, err := parseFileMode(cfg.Mode)
+		if err != nil {
+			return nil, errors.Join(err, l.Close())
+		}
+		if err := os.Chmod(cfg.Addr, mode); err != nil {
+			return nil, errors.Join(kerrors.WithMsg(err, fmt.Sprintf("Failed to chmod unix socket %s", cfg.Addr)), l.Close())
+		}
+	}
+	if cfg.Owner != "" || cfg.Group != "" {
+		uid, err := lookupUID(cfg.Owner)
+		if err != nil {
+			return nil, errors.Join(err, l.Close())
+		}
+		gid, err := lookupGID(cfg.Group)
+		if err != nil {
+			return nil, errors.Join(err, l.Close())
+		}
+		if err := os.Chown(cfg.Addr, uid, gid); err != nil {
+			return nil, errors.Join(kerrors.WithMsg(err, fmt.Sprintf("Failed to chown unix socket %s", cfg.Addr)), l.Close())
+		}
+	}
+	return l, nil
+}
+
+func closeBoundListeners(listeners []boundListener) error {
+	var errs []error
+	for _, i := range listeners {
+		if err := i.l.Close(); err != nil {
+			errs = append(errs, kerrors.WithMsg(err, fmt.Sprintf("Failed to close listener %s", i.l.Addr())))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func openListeners(listeners []Listener) (_ []boundListener, retErr error) {
+	var bound []boundListener
+	defer func() {
+		if retErr != nil {
+			retErr = errors.Join(retErr, closeBoundListeners(bound))
+		}
+	}()
+
+	var sdFDs []systemdFD
+	sdLoaded := false
+	defer func() {
+		// close any inherited systemd sockets that are not used
+		if err := closeSystemdFDs(sdFDs); err != nil {
+			retErr = errors.Join(retErr, err)
+		}
+	}()
+
+	for _, i := range listeners {
+		switch i.Network {
+		case listenerNetworkTCP:
+			l, err := net.Listen(listenerNetworkTCP, i.Addr)
+			if err != nil {
+				return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to listen on tcp addr %s", i.Addr))
+			}
+			bound = append(bound, boundListener{l: l, cfg: i})
+		case listenerNetworkUnix:
+			l, err := listenUnix(i)
+			if err != nil {
+				return nil, err
+			}
+			bound = append(bound, boundListener{l: l, cfg: i})
+		case listenerNetworkSystemd:
+			if !sdLoaded {
+				var err error
+				sdFDs, err = listenSystemd()
+				if err != nil {
+					return nil, err
+				}
+				sdLoaded = true
+			}
+			found := false
+			for n, j := range sdFDs {
+				if j.l == nil {
+					continue
+				}
+				if i.Addr != "" && j.name != i.Addr {
+					continue
+				}
+				found = true
+				bound = append(bound, boundListener{l: j.l, cfg: i})
+				sdFDs[n].l = nil
+			}
+			if !found {
+				return nil, kerrors.WithMsg(nil, fmt.Sprintf("No systemd socket found for name %q", i.Addr))
+			}
+		default:
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid listener network %s", i.Network))
+		}
+	}
+	return bound, nil
+}
@@ -0,0 +1,269 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	// serverMetrics are the server metrics exposed in the prometheus text
+	// format
+	serverMetrics struct {
+		mu        sync.Mutex
+		requests  map[requestMetricLabels]*requestMetrics
+		xattr     map[string]uint64
+		conns     map[net.Conn]http.ConnState
+		connCount map[http.ConnState]int64
+		inFlight  atomic.Int64
+	}
+
+	requestMetricLabels struct {
+		route    string
+		status   string
+		encoding string
+	}
+
+	requestMetrics struct {
+		count   uint64
+		bytes   uint64
+		buckets []uint64
+		sum     float64
+	}
+
+	ctxKeyMetrics struct{}
+)
+
+const (
+	metricsPath = "/metrics"
+
+	mediaTypePrometheusText = "text/plain; version=0.0.4; charset=utf-8"
+
+	metricsEncodingIdentity = "identity"
+
+	xattrResultHit   = "hit"
+	xattrResultMiss  = "miss"
+	xattrResultStale = "stale"
+	xattrResultError = "error"
+)
+
+// latencyBuckets are the upper bounds in seconds of the request latency
+// histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	xattrResults = []string{xattrResultHit, xattrResultMiss, xattrResultStale, xattrResultError}
+	connStates   = []http.ConnState{http.StateNew, http.StateActive, http.StateIdle}
+)
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:  map[requestMetricLabels]*requestMetrics{},
+		xattr:     map[string]uint64{},
+		conns:     map[net.Conn]http.ConnState{},
+		connCount: map[http.ConnState]int64{},
+	}
+}
+
+func getCtxMetrics(ctx context.Context) *serverMetrics {
+	v, _ := ctx.Value(ctxKeyMetrics{}).(*serverMetrics)
+	return v
+}
+
+// observeRequest records a completed request
+func (m *serverMetrics) observeRequest(route string, status int, encoding string, written uint64, latency time.Duration) {
+	if encoding == "" {
+		encoding = metricsEncodingIdentity
+	}
+	labels := requestMetricLabels{
+		route:    route,
+		status:   strconv.Itoa(status),
+		encoding: encoding,
+	}
+	seconds := latency.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.requests[labels]
+	if !ok {
+		v = &requestMetrics{
+			buckets: make([]uint64, len(latencyBuckets)),
+		}
+		m.requests[labels] = v
+	}
+	v.count++
+	v.bytes += written
+	v.sum += seconds
+	for n, i := range latencyBuckets {
+		if seconds <= i {
+			v.buckets[n]++
+		}
+	}
+}
+
+// observeXAttr records the result of reading a checksum xattr. It is a no-op
+// on a nil receiver so that files may be served without metrics.
+func (m *serverMetrics) observeXAttr(result string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.xattr[result]++
+}
+
+// connState tracks the number of connections in each state, and is used as
+// [net/http.Server.ConnState]
+func (m *serverMetrics) connState(conn net.Conn, state http.ConnState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if prev, ok := m.conns[conn]; ok {
+		m.connCount[prev]--
+	}
+	if state == http.StateClosed || state == http.StateHijacked {
+		// hijacked connections are no longer managed by the server
+		delete(m.conns, conn)
+		return
+	}
+	m.conns[conn] = state
+	m.connCount[state]++
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeMetricHeader(b *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (l requestMetricLabels) String() string {
+	return fmt.Sprintf(`route="%s",status="%s",encoding="%s"`, escapeLabelValue(l.route), l.status, escapeLabelValue(l.encoding))
+}
+
+// writeTo writes the metrics in the prometheus text format
+func (m *serverMetrics) writeTo(w io.Writer) error {
+	var b bytes.Buffer
+
+	m.mu.Lock()
+	labels := make([]requestMetricLabels, 0, len(m.requests))
+	for k := range m.requests {
+		labels = append(labels, k)
+	}
+	slices.SortFunc(labels, func(a, b requestMetricLabels) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	requests := make([]requestMetrics, 0, len(labels))
+	for _, i := range labels {
+		v := *m.requests[i]
+		v.buckets = slices.Clone(v.buckets)
+		requests = append(requests, v)
+	}
+	xattr := make([]uint64, 0, len(xattrResults))
+	for _, i := range xattrResults {
+		xattr = append(xattr, m.xattr[i])
+	}
+	conns := make([]int64, 0, len(connStates))
+	for _, i := range connStates {
+		conns = append(conns, m.connCount[i])
+	}
+	m.mu.Unlock()
+
+	writeMetricHeader(&b, "fsserve_http_requests_total", "counter", "Total number of http requests.")
+	for n, i := range labels {
+		fmt.Fprintf(&b, "fsserve_http_requests_total{%s} %d\n", i, requests[n].count)
+	}
+
+	writeMetricHeader(&b, "fsserve_http_response_bytes_total", "counter", "Total number of http response body bytes sent.")
+	for n, i := range labels {
+		fmt.Fprintf(&b, "fsserve_http_response_bytes_total{%s} %d\n", i, requests[n].bytes)
+	}
+
+	writeMetricHeader(&b, "fsserve_http_request_duration_seconds", "histogram", "Latency of http requests in seconds.")
+	for n, i := range labels {
+		v := requests[n]
+		for k, j := range latencyBuckets {
+			fmt.Fprintf(&b, "fsserve_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", i, formatFloat(j), v.buckets[k])
+		}
+		fmt.Fprintf(&b, "fsserve_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", i, v.count)
+		fmt.Fprintf(&b, "fsserve_http_request_duration_seconds_sum{%s} %s\n", i, formatFloat(v.sum))
+		fmt.Fprintf(&b, "fsserve_http_request_duration_seconds_count{%s} %d\n", i, v.count)
+	}
+
+	routes := map[string][2]uint64{}
+	for n, i := range labels {
+		v := routes[i.route]
+		v[0] += requests[n].count
+		if i.status == strconv.Itoa(http.StatusNotModified) {
+			v[1] += requests[n].count
+		}
+		routes[i.route] = v
+	}
+	routeNames := make([]string, 0, len(routes))
+	for k := range routes {
+		routeNames = append(routeNames, k)
+	}
+	slices.Sort(routeNames)
+	writeMetricHeader(&b, "fsserve_http_not_modified_ratio", "gauge", "Ratio of http requests answered with 304 Not Modified.")
+	for _, i := range routeNames {
+		v := routes[i]
+		fmt.Fprintf(&b, "fsserve_http_not_modified_ratio{route=\"%s\"} %s\n", escapeLabelValue(i), formatFloat(float64(v[1])/float64(v[0])))
+	}
+
+	writeMetricHeader(&b, "fsserve_http_requests_in_flight", "gauge", "Number of http requests being handled.")
+	fmt.Fprintf(&b, "fsserve_http_requests_in_flight %d\n", m.inFlight.Load())
+
+	writeMetricHeader(&b, "fsserve_checksum_xattr_total", "counter", "Total number of checksum xattr reads by result.")
+	for n, i := range xattrResults {
+		fmt.Fprintf(&b, "fsserve_checksum_xattr_total{result=\"%s\"} %d\n", i, xattr[n])
+	}
+
+	writeMetricHeader(&b, "fsserve_http_connections", "gauge", "Number of http connections by state.")
+	for n, i := range connStates {
+		fmt.Fprintf(&b, "fsserve_http_connections{state=\"%s\"} %d\n", i, conns[n])
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// adminHandler returns the handler of the admin listeners
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, s.serveMetrics)
+	for _, i := range []string{healthzPath, readyzPath, versionPath} {
+		mux.HandleFunc(i, s.serveProbe)
+	}
+	return mux
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set(headerAllow, "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set(headerContentType, mediaTypePrometheusText)
+	w.Header().Set(headerCacheControl, "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := s.metrics.writeTo(w); err != nil {
+		s.log.Err(r.Context(), kerrors.WithMsg(err, "Failed writing metrics"))
+	}
+}
@@ -0,0 +1,279 @@
+package serve
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type (
+	acceptItem struct {
+		value string
+		q     int
+	}
+
+	acceptEncodings struct {
+		present  bool
+		codes    map[string]int
+		wildcard int
+	}
+)
+
+const (
+	// qMax is the max quality weight in thousandths
+	qMax = 1000
+	// qImplicit is the weight of an implicitly acceptable value, which is
+	// acceptable but less preferred than any explicitly weighted value
+	qImplicit = 1
+
+	encodingIdentity = "identity"
+	acceptWildcard   = "*"
+)
+
+// parseQValue parses a quality weight into thousandths
+func parseQValue(s string) (int, bool) {
+	if s == "" || len(s) > 5 {
+		return 0, false
+	}
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole != "0" && whole != "1" {
+		return 0, false
+	}
+	if len(frac) > 3 {
+		return 0, false
+	}
+	q := 0
+	if whole == "1" {
+		q = qMax
+	}
+	if hasFrac {
+		digits := frac + strings.Repeat("0", 3-len(frac))
+		k, err := strconv.Atoi(digits)
+		if err != nil || k < 0 {
+			return 0, false
+		}
+		if whole == "1" && k != 0 {
+			return 0, false
+		}
+		q += k
+	}
+	return q, true
+}
+
+// parseAccept parses a comma separated list of header values with optional
+// quality weights as described by RFC 9110 section 12.4.2. Values with an
+// invalid weight are omitted.
+func parseAccept(values []string) []acceptItem {
+	var items []acceptItem
+	for _, header := range values {
+		for _, directive := range strings.Split(header, ",") {
+			value, params, _ := strings.Cut(directive, ";")
+			value = strings.ToLower(strings.TrimSpace(value))
+			if value == "" {
+				continue
+			}
+			q := qMax
+			valid := true
+			for _, p := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(p, "=")
+				k = strings.TrimSpace(k)
+				if !strings.EqualFold(k, "q") {
+					continue
+				}
+				q, valid = parseQValue(strings.TrimSpace(v))
+				break
+			}
+			if !valid {
+				continue
+			}
+			items = append(items, acceptItem{
+				value: value,
+				q:     q,
+			})
+		}
+	}
+	return items
+}
+
+var encodingAliases = map[string]string{
+	"x-gzip":     "gzip",
+	"x-compress": "compress",
+}
+
+func parseAcceptEncoding(reqHeaders http.Header) acceptEncodings {
+	values, present := reqHeaders[headerAcceptEncoding]
+	a := acceptEncodings{
+		present:  present,
+		codes:    map[string]int{},
+		wildcard: -1,
+	}
+	for _, i := range parseAccept(values) {
+		code := i.value
+		if alias, ok := encodingAliases[code]; ok {
+			code = alias
+		}
+		if code == acceptWildcard {
+			a.wildcard = max(a.wildcard, i.q)
+			continue
+		}
+		if prev, ok := a.codes[code]; ok && prev >= i.q {
+			continue
+		}
+		a.codes[code] = i.q
+	}
+	return a
+}
+
+// weight returns the client weight of a content coding in thousandths, where
+// 0 is not acceptable.
+//
+// A request without an Accept-Encoding header only accepts identity. Identity
+// is otherwise acceptable unless excluded by "identity;q=0" or "*;q=0", and is
+// less preferred than any other acceptable coding when not explicitly
+// weighted.
+func (a acceptEncodings) weight(code string) int {
+	if !a.present {
+		if code == encodingIdentity {
+			return qMax
+		}
+		return 0
+	}
+	if q, ok := a.codes[code]; ok {
+		return q
+	}
+	if code == encodingIdentity {
+		if a.wildcard == 0 {
+			return 0
+		}
+		return qImplicit
+	}
+	if a.wildcard > 0 {
+		return a.wildcard
+	}
+	return 0
+}
+
+type (
+	acceptMediaTypes struct {
+		present bool
+		items   []acceptItem
+	}
+)
+
+func parseAcceptMediaTypes(reqHeaders http.Header) acceptMediaTypes {
+	values, present := reqHeaders[headerAccept]
+	return acceptMediaTypes{
+		present: present,
+		items:   parseAccept(values),
+	}
+}
+
+// weight returns the client weight of a media type in thousandths, where 0 is
+// not acceptable. The weight is determined by the most specific matching
+// media range. A request without an Accept header accepts all media types.
+func (a acceptMediaTypes) weight(ctype string) int {
+	if !a.present {
+		return qMax
+	}
+	mediaType, _, _ := strings.Cut(ctype, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	kind, _, _ := strings.Cut(mediaType, "/")
+	q := 0
+	specificity := 0
+	for _, i := range a.items {
+		s := 0
+		switch i.value {
+		case mediaType:
+			s = 3
+		case kind + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		default:
+			continue
+		}
+		if s > specificity || s == specificity && i.q > q {
+			specificity = s
+			q = i.q
+		}
+	}
+	return q
+}
+
+type (
+	acceptLanguages struct {
+		present bool
+		items   []acceptItem
+	}
+)
+
+func parseAcceptLanguage(reqHeaders http.Header) acceptLanguages {
+	values, present := reqHeaders[headerAcceptLanguage]
+	return acceptLanguages{
+		present: present,
+		items:   parseAccept(values),
+	}
+}
+
+// weight returns the client weight of a language tag in thousandths, where 0
+// is not acceptable.
+//
+// The weight is determined by the most specific matching language range. A
+// range matches a tag if it is equal to the tag or is a prefix of the tag as
+// described by RFC 4647 section 3.3.1. A range also matches a tag that is its
+// prefix, so that a tag of en is acceptable to a client requesting en-us.
+func (a acceptLanguages) weight(tag string) int {
+	tag = strings.ToLower(tag)
+	q := 0
+	specificity := 0
+	for _, i := range a.items {
+		s := 0
+		switch {
+		case i.value == tag:
+			s = 4
+		case strings.HasPrefix(tag, i.value+"-"):
+			s = 3
+		case strings.HasPrefix(i.value, tag+"-"):
+			s = 2
+		case i.value == acceptWildcard:
+			s = 1
+		default:
+			continue
+		}
+		if s > specificity || s == specificity && i.q > q {
+			specificity = s
+			q = i.q
+		}
+	}
+	return q
+}
+
+// rank returns the acceptable language tags in order of client weight, with
+// ties broken by the order of tags
+func (a acceptLanguages) rank(tags []string) []string {
+	if !a.present {
+		return nil
+	}
+	type weighted struct {
+		tag string
+		q   int
+	}
+	var ranked []weighted
+	for _, i := range tags {
+		q := a.weight(i)
+		if q == 0 {
+			continue
+		}
+		ranked = append(ranked, weighted{tag: i, q: q})
+	}
+	slices.SortStableFunc(ranked, func(a, b weighted) int {
+		return cmp.Compare(b.q, a.q)
+	})
+	res := make([]string, 0, len(ranked))
+	for _, i := range ranked {
+		res = append(res, i.tag)
+	}
+	return res
+}
@@ -0,0 +1,183 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	// RateLimit is a token bucket rate limit keyed on the real client ip
+	//
+	// Rate is the number of requests per second refilled into the bucket of
+	// each ip, and Burst is the size of the bucket. The limit is disabled if
+	// Rate is 0. Allow are ip prefixes which are not limited. Requests with an
+	// unknown ip share a single bucket.
+	RateLimit struct {
+		Rate  float64  `mapstructure:"rate"`
+		Burst int      `mapstructure:"burst"`
+		Allow []string `mapstructure:"allow"`
+		allow []netip.Prefix
+	}
+
+	// rateLimiter is the token buckets of all rate limits. Buckets are removed
+	// once they have refilled and are idle.
+	rateLimiter struct {
+		mu        sync.Mutex
+		buckets   map[string]*rateBucket
+		lastSweep time.Time
+		now       func() time.Time
+	}
+
+	rateBucket struct {
+		tokens float64
+		last   time.Time
+		full   time.Time
+	}
+
+	rateDecision struct {
+		ok         bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}
+
+	ctxKeyRealIP struct{}
+)
+
+const (
+	headerRetryAfter         = "Retry-After"
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+	headerRateLimitPolicy    = "RateLimit-Policy"
+
+	rateLimitSweepInterval = time.Minute
+
+	scopeGlobal = "global"
+)
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+func parseRateLimit(l *RateLimit, scope string) error {
+	if l.Rate < 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate) {
+		return kerrors.WithMsg(nil, fmt.Sprintf("Invalid rate limit rate for %s", scope))
+	}
+	if l.Burst < 0 {
+		return kerrors.WithMsg(nil, fmt.Sprintf("Invalid rate limit burst for %s", scope))
+	}
+	if l.enabled() && l.Burst == 0 {
+		l.Burst = max(1, int(math.Ceil(l.Rate)))
+	}
+	var err error
+	l.allow, err = parsePrefixes(l.Allow)
+	if err != nil {
+		return kerrors.WithMsg(err, fmt.Sprintf("Invalid rate limit allow list for %s", scope))
+	}
+	return nil
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: map[string]*rateBucket{},
+		now:     time.Now,
+	}
+}
+
+// take takes a token from the bucket of a key
+func (r *rateLimiter) take(key string, limit RateLimit) rateDecision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if now.Sub(r.lastSweep) >= rateLimitSweepInterval {
+		r.sweepLocked(now)
+	}
+
+	burst := float64(limit.Burst)
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &rateBucket{
+			tokens: burst,
+			last:   now,
+		}
+		r.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(burst, b.tokens+elapsed.Seconds()*limit.Rate)
+	}
+	// buckets may exceed the burst if the limit is reloaded
+	b.tokens = min(burst, b.tokens)
+	b.last = now
+
+	d := rateDecision{}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.ok = true
+	} else {
+		d.retryAfter = rateDuration(1-b.tokens, limit.Rate)
+	}
+	d.remaining = int(b.tokens)
+	d.reset = rateDuration(burst-b.tokens, limit.Rate)
+	b.full = now.Add(d.reset)
+	return d
+}
+
+func rateDuration(tokens float64, rate float64) time.Duration {
+	return time.Duration(tokens / rate * float64(time.Second))
+}
+
+// sweepLocked removes buckets which have refilled, since they are equivalent
+// to a new bucket
+func (r *rateLimiter) sweepLocked(now time.Time) {
+	r.lastSweep = now
+	for k, v := range r.buckets {
+		if !now.Before(v.full) {
+			delete(r.buckets, k)
+		}
+	}
+}
+
+func getCtxRealIP(ctx context.Context) netip.Addr {
+	v, _ := ctx.Value(ctxKeyRealIP{}).(netip.Addr)
+	return v
+}
+
+// ceilSeconds returns a duration in whole seconds rounded up
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// checkRateLimit takes a token from the bucket of the real ip of a request,
+// and returns an error if the request is limited
+func (r *rateLimiter) checkRateLimit(w http.ResponseWriter, req *http.Request, scope string, limit RateLimit) error {
+	if !limit.enabled() {
+		return nil
+	}
+	key := "unknown"
+	if ip := getCtxRealIP(req.Context()); ip.IsValid() {
+		if ipnetsContain(ip, limit.allow) {
+			return nil
+		}
+		key = ip.String()
+	}
+	d := r.take(scope+" "+key, limit)
+	if d.ok {
+		return nil
+	}
+	w.Header().Set(headerRetryAfter, ceilSeconds(d.retryAfter))
+	w.Header().Set(headerRateLimitLimit, strconv.Itoa(limit.Burst))
+	w.Header().Set(headerRateLimitRemaining, strconv.Itoa(d.remaining))
+	w.Header().Set(headerRateLimitReset, ceilSeconds(d.reset))
+	w.Header().Set(headerRateLimitPolicy, fmt.Sprintf("%d;w=%s", limit.Burst, ceilSeconds(rateDuration(float64(limit.Burst), limit.Rate))))
+	return kerrors.WithKind(nil, ErrTooManyRequests, fmt.Sprintf("Rate limit exceeded for %s", scope))
+}
@@ -0,0 +1,172 @@
+package serve
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"xorkevin.dev/kerrors"
+)
+
+type (
+	// Rules are redirect and internal rewrite rules applied to the request
+	// path before it is routed
+	//
+	// Redirects are applied before rewrites, and the first matching rule of
+	// each is used.
+	Rules struct {
+		Redirects []Rule `mapstructure:"redirects"`
+		Rewrites  []Rule `mapstructure:"rewrites"`
+	}
+
+	// Rule is a redirect or rewrite rule
+	//
+	// Match may be one of exact, prefix, or regex, and defaults to exact. For
+	// prefix matches, From matches whole path segments, and the remainder of
+	// the path after From is appended to To.
+	// For regex matches, To may reference capture groups of From like $1 or
+	// ${name}. Leading slashes of a path target are collapsed so that it may
+	// not redirect to another host. The query string of the request is kept
+	// unless To has its own.
+	// Status is the redirect status code, and defaults to 302. It is unused by
+	// rewrites.
+	Rule struct {
+		Match  string `mapstructure:"match"`
+		From   string `mapstructure:"from"`
+		To     string `mapstructure:"to"`
+		Status int    `mapstructure:"status"`
+		regex  *regexp.Regexp
+	}
+)
+
+const (
+	ruleMatchExact  = "exact"
+	ruleMatchPrefix = "prefix"
+	ruleMatchRegex  = "regex"
+)
+
+var redirectStatuses = map[int]struct{}{
+	http.StatusMovedPermanently:  {},
+	http.StatusFound:             {},
+	http.StatusSeeOther:          {},
+	http.StatusTemporaryRedirect: {},
+	http.StatusPermanentRedirect: {},
+}
+
+func parseRuleList(rules []Rule, kind string, redirect bool) error {
+	for n, i := range rules {
+		if i.From == "" {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Missing %s rule from", kind))
+		}
+		if i.To == "" {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Missing %s rule to for %s", kind, i.From))
+		}
+		switch i.Match {
+		case "", ruleMatchExact, ruleMatchPrefix:
+		case ruleMatchRegex:
+			var err error
+			rules[n].regex, err = regexp.Compile(i.From)
+			if err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Invalid %s rule regex %s", kind, i.From))
+			}
+		default:
+			return kerrors.WithMsg(nil, fmt.Sprintf("Invalid %s rule match %s for %s", kind, i.Match, i.From))
+		}
+		if redirect {
+			if i.Status == 0 {
+				rules[n].Status = http.StatusFound
+			} else if _, ok := redirectStatuses[i.Status]; !ok {
+				return kerrors.WithMsg(nil, fmt.Sprintf("Invalid %s rule status %d for %s", kind, i.Status, i.From))
+			}
+		} else {
+			if !strings.HasPrefix(i.To, "/") {
+				return kerrors.WithMsg(nil, fmt.Sprintf("Rewrite rule to %s must be an absolute path", i.To))
+			}
+		}
+	}
+	return nil
+}
+
+func parseRules(rules Rules) error {
+	if err := parseRuleList(rules.Redirects, "redirect", true); err != nil {
+		return err
+	}
+	if err := parseRuleList(rules.Rewrites, "rewrite", false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// cleanTargetPath collapses the leading slashes of a path target so that a
+// target built from the request path may not be a network path reference to
+// another host like //example.com. Targets configured with a scheme or host
+// are returned unchanged.
+func cleanTargetPath(to string, target string) string {
+	if !strings.HasPrefix(to, "/") || strings.HasPrefix(to, "//") || strings.HasPrefix(to, `/\`) {
+		return target
+	}
+	// browsers treat backslashes as slashes
+	return "/" + strings.TrimLeft(target, `/\`)
+}
+
+// target returns the target of a rule if it matches the path
+func (r Rule) target(p string) (string, bool) {
+	switch r.Match {
+	case ruleMatchPrefix:
+		rest, ok := strings.CutPrefix(p, r.From)
+		if !ok {
+			return "", false
+		}
+		if !strings.HasSuffix(r.From, "/") && rest != "" && !strings.HasPrefix(rest, "/") {
+			return "", false
+		}
+		return cleanTargetPath(r.To, r.To+rest), true
+	case ruleMatchRegex:
+		m := r.regex.FindStringSubmatchIndex(p)
+		if m == nil {
+			return "", false
+		}
+		return cleanTargetPath(r.To, string(r.regex.ExpandString(nil, r.To, p, m))), true
+	default:
+		if p != r.From {
+			return "", false
+		}
+		return r.To, true
+	}
+}
+
+func matchRules(rules []Rule, p string) (*Rule, string, bool) {
+	for n, i := range rules {
+		if target, ok := i.target(p); ok {
+			return &rules[n], target, true
+		}
+	}
+	return nil, "", false
+}
+
+// withQuery returns a target with the query string of a request if the target
+// does not have its own
+func withQuery(target string, u *url.URL) string {
+	if u.RawQuery == "" || strings.Contains(target, "?") {
+		return target
+	}
+	return target + "?" + u.RawQuery
+}
+
+// rewriteRequest returns a shallow copy of a request with a rewritten url
+func rewriteRequest(r *http.Request, target string) (*http.Request, error) {
+	u, err := url.Parse(withQuery(target, r.URL))
+	if err != nil {
+		return nil, kerrors.WithMsg(err, fmt.Sprintf("Invalid rewrite target %s", target))
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = u.Path
+	r2.URL.RawPath = u.RawPath
+	r2.URL.RawQuery = u.RawQuery
+	return r2, nil
+}
@@ -1,21 +1,27 @@
 package serve
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/fs"
 	"mime"
+	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -32,12 +38,27 @@ var (
 	ErrInvalidReq errInvalidReq
 	// ErrMalformedChecksum is returned when a file checksum is malformed
 	ErrMalformedChecksum errMalformedChecksum
+	// ErrNotAcceptable is returned when no file variant is acceptable
+	ErrNotAcceptable errNotAcceptable
+	// ErrMethodNotAllowed is returned when a request method is not supported
+	ErrMethodNotAllowed errMethodNotAllowed
+	// ErrTooManyRequests is returned when a client exceeds a rate limit
+	ErrTooManyRequests errTooManyRequests
+	// ErrForbidden is returned when a client is not permitted to make a request
+	ErrForbidden errForbidden
+	// ErrUnauthorized is returned when a client is not authenticated
+	ErrUnauthorized errUnauthorized
 )
 
 type (
 	errNotFound          struct{}
 	errInvalidReq        struct{}
 	errMalformedChecksum struct{}
+	errNotAcceptable     struct{}
+	errMethodNotAllowed  struct{}
+	errTooManyRequests   struct{}
+	errForbidden         struct{}
+	errUnauthorized      struct{}
 )
 
 func (e errNotFound) Error() string {
@@ -52,6 +73,26 @@ func (e errMalformedChecksum) Error() string {
 	return "Malformed checksum"
 }
 
+func (e errNotAcceptable) Error() string {
+	return "No acceptable file variant"
+}
+
+func (e errMethodNotAllowed) Error() string {
+	return "Method not allowed"
+}
+
+func (e errTooManyRequests) Error() string {
+	return "Too many requests"
+}
+
+func (e errForbidden) Error() string {
+	return "Forbidden"
+}
+
+func (e errUnauthorized) Error() string {
+	return "Unauthorized"
+}
+
 type (
 	MimeType struct {
 		Ext         string `mapstructure:"ext" json:"ext"`
@@ -59,6 +100,19 @@ type (
 	}
 )
 
+// ValidateMimeTypes validates mime types without adding them
+func ValidateMimeTypes(mimeTypes []MimeType) error {
+	for _, i := range mimeTypes {
+		if !strings.HasPrefix(i.Ext, ".") {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Extension %s must begin with a period", i.Ext))
+		}
+		if _, _, err := mime.ParseMediaType(i.ContentType); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Invalid content type %s for ext %s", i.ContentType, i.Ext))
+		}
+	}
+	return nil
+}
+
 func AddMimeTypes(mimeTypes []MimeType) error {
 	for _, i := range mimeTypes {
 		if err := mime.AddExtensionType(i.Ext, i.ContentType); err != nil {
@@ -72,14 +126,62 @@ type (
 	Server struct {
 		log      *klog.LevelLogger
 		dir      fs.FS
-		mux      *http.ServeMux
+		state    *atomic.Pointer[serverState]
 		config   Config
+		compress *compressCache
+		limiter  *rateLimiter
+		metrics  *serverMetrics
 		reqcount *atomic.Uint32
+		mounted  atomic.Bool
+		draining atomic.Bool
+		// clientCerts is set once the server is serving
+		clientCerts atomic.Pointer[clientCertSupport]
+	}
+
+	// serverState is the mounted route table. It is swapped atomically on
+	// reload, and each request is handled entirely by the state loaded at the
+	// start of the request.
+	serverState struct {
+		mux        *http.ServeMux
+		routes     []Route
+		rules      Rules
+		proxies    []netip.Prefix
+		errorPages *errorPageSet
+		ipFilter   IPFilter
+		rateLimit  RateLimit
+		accessLog  *accessLogFormat
+		globals    Globals
+	}
+
+	// Globals is the server wide config which may be changed by
+	// [Server.Reload]
+	//
+	// MimeTypes are registered process wide when they are reloaded, and may
+	// not be unregistered, so removed exts keep their previous mime type until
+	// the process is restarted.
+	Globals struct {
+		ErrorPages ErrorPages
+		IPFilter   IPFilter
+		RateLimit  RateLimit
+		AccessLog  AccessLog
+		MimeTypes  []MimeType
 	}
 
+	// Config is the server config. Proxies, ErrorPages, IPFilter, RateLimit,
+	// and AccessLog are the initial values of config which may be reloaded.
 	Config struct {
-		Instance string
-		Proxies  []netip.Prefix
+		Instance      string
+		Proxies       []netip.Prefix
+		CompressCache CompressCacheConfig
+		ErrorPages    ErrorPages
+		IPFilter      IPFilter
+		RateLimit     RateLimit
+		SignKey       []byte
+		BuildInfo     BuildInfo
+		AccessLog     AccessLog
+		// AccessLogWriter receives access log lines if set, and must be safe for
+		// concurrent use
+		AccessLogWriter io.Writer
 	}
 
 	Opts struct {
@@ -89,35 +191,76 @@ type (
 		IdleTimeout       time.Duration
 		MaxHeaderBytes    int
 		GracefulShutdown  time.Duration
+		Listeners         []Listener
+		AdminListeners    []Listener
+		TLS               TLSOpts
 	}
 
 	serverSubdir struct {
-		log   *klog.LevelLogger
-		dir   fs.FS
-		route Route
+		log        *klog.LevelLogger
+		dir        fs.FS
+		route      Route
+		compress   *compressCache
+		errorPages *errorPageSet
+		control    *controlFiles
+		limiter    *rateLimiter
+		signKey    []byte
 	}
 
 	serverFile struct {
-		log   *klog.LevelLogger
-		dir   fs.FS
-		route Route
+		log        *klog.LevelLogger
+		dir        fs.FS
+		route      Route
+		compress   *compressCache
+		errorPages *errorPageSet
+		limiter    *rateLimiter
+		signKey    []byte
+	}
+
+	notFoundHandler struct {
+		log *klog.LevelLogger
 	}
 
 	Route struct {
-		Prefix             string     `mapstructure:"prefix"`
-		Dir                bool       `mapstructure:"dir"`
-		Path               string     `mapstructure:"path"`
-		Include            string     `mapstructure:"include"`
-		Exclude            string     `mapstructure:"exclude"`
-		Encodings          []Encoding `mapstructure:"encodings"`
-		DefaultContentType string     `mapstructure:"default_content_type"`
-		CacheControl       string     `mapstructure:"cachecontrol"`
-		DisableXAttr       bool       `mapstructure:"disable_xattr"`
-		XAttrChecksum      string     `mapstructure:"xattr_checksum"`
-		StrongETagOverride bool       `mapstructure:"strong_etag_override"`
-		DirList            bool       `mapstructure:"dir_list"`
-		include            *regexp.Regexp
-		exclude            *regexp.Regexp
+		Prefix               string             `mapstructure:"prefix"`
+		Dir                  bool               `mapstructure:"dir"`
+		Path                 string             `mapstructure:"path"`
+		Include              string             `mapstructure:"include"`
+		Exclude              string             `mapstructure:"exclude"`
+		Encodings            []Encoding         `mapstructure:"encodings"`
+		Variants             []Variant          `mapstructure:"variants"`
+		Localize             Localization       `mapstructure:"localize"`
+		DefaultContentType   string             `mapstructure:"default_content_type"`
+		CacheControl         string             `mapstructure:"cachecontrol"`
+		CacheControlRules    []CacheControlRule `mapstructure:"cachecontrol_rules"`
+		DisableXAttr         bool               `mapstructure:"disable_xattr"`
+		XAttrChecksum        string             `mapstructure:"xattr_checksum"`
+		StrongETagOverride   bool               `mapstructure:"strong_etag_override"`
+		DirList              bool               `mapstructure:"dir_list"`
+		DirListTemplate      string             `mapstructure:"dir_list_template"`
+		DirListLimit         int                `mapstructure:"dir_list_limit"`
+		DirListMaxDepth      int                `mapstructure:"dir_list_max_depth"`
+		HideEncoded          bool               `mapstructure:"hide_encoded"`
+		DenyEncoded          bool               `mapstructure:"deny_encoded"`
+		Index                []string           `mapstructure:"index"`
+		TrailingSlash        string             `mapstructure:"trailing_slash"`
+		Fallback             string             `mapstructure:"fallback"`
+		FallbackCacheControl string             `mapstructure:"fallback_cachecontrol"`
+		ErrorPages           map[string]string  `mapstructure:"error_pages"`
+		ProblemJSON          bool               `mapstructure:"problem_json"`
+		ControlFiles         bool               `mapstructure:"control_files"`
+		Headers              []HeaderRule       `mapstructure:"headers"`
+		CORS                 CORS               `mapstructure:"cors"`
+		IPFilter             IPFilter           `mapstructure:"ipfilter"`
+		RateLimit            RateLimit          `mapstructure:"ratelimit"`
+		Auth                 Auth               `mapstructure:"auth"`
+		Signed               bool               `mapstructure:"signed"`
+		ClientCert           ClientCert         `mapstructure:"client_cert"`
+		Compress             Compression        `mapstructure:"compress"`
+		include              *regexp.Regexp
+		exclude              *regexp.Regexp
+		dirListTemplate      *template.Template
+		errorPages           map[int]string
 	}
 
 	Encoding struct {
@@ -127,26 +270,86 @@ type (
 		match *regexp.Regexp
 	}
 
+	// CacheControlRule is the Cache-Control of files of a route
+	//
+	// Match is a regex of the file path relative to the route. The first
+	// matching rule is used, and the route CacheControl otherwise.
+	CacheControlRule struct {
+		Match        string `mapstructure:"match"`
+		CacheControl string `mapstructure:"cachecontrol"`
+		match        *regexp.Regexp
+	}
+
+	// HeaderRule is a set of response headers for files of a route
+	//
+	// Match is a regex of the file path relative to the route, and matches all
+	// files if empty. Headers of later rules take precedence.
+	HeaderRule struct {
+		Match   string            `mapstructure:"match"`
+		Headers map[string]string `mapstructure:"headers"`
+		match   *regexp.Regexp
+		headers http.Header
+	}
+
+	// Variant is an alternate format of a file, selected by the Accept header
+	Variant struct {
+		ContentType string `mapstructure:"contenttype"`
+		Match       string `mapstructure:"match"`
+		Ext         string `mapstructure:"ext"`
+		match       *regexp.Regexp
+	}
+
+	// Localization selects a localized sibling of a file by the Accept-Language
+	// header, such as index.en.html for index.html
+	//
+	// Languages are the available language tags in order of preference. Default
+	// is used when no language is acceptable to the client. Query and Cookie
+	// optionally name a query param and cookie that override the negotiated
+	// language.
+	Localization struct {
+		Languages []string `mapstructure:"languages"`
+		Default   string   `mapstructure:"default"`
+		Query     string   `mapstructure:"query"`
+		Cookie    string   `mapstructure:"cookie"`
+	}
+
 	fileConfig struct {
-		path     string
-		basename string
-		ctype    string
-		encoding string
-		checksum string
-		tag      string
+		path         string
+		basename     string
+		ctype        string
+		encoding     string
+		language     string
+		dynamic      bool
+		checksum     string
+		tag          string
+		modtime      time.Time
+		cachecontrol string
+		vary         []string
+		headers      http.Header
 	}
 )
 
 const (
+	headerAccept          = "Accept"
 	headerAcceptEncoding  = "Accept-Encoding"
+	headerAcceptLanguage  = "Accept-Language"
 	headerCacheControl    = "Cache-Control"
 	headerContentEncoding = "Content-Encoding"
+	headerContentLanguage = "Content-Language"
 	headerContentType     = "Content-Type"
+	headerCookie          = "Cookie"
 	headerETag            = "ETag"
 	headerIfNoneMatch     = "If-None-Match"
+	headerLocation        = "Location"
+	headerSecFetchMode    = "Sec-Fetch-Mode"
 	headerVary            = "Vary"
 )
 
+const (
+	trailingSlashAdd   = "add"
+	trailingSlashStrip = "strip"
+)
+
 func getErrorStatus(err error) int {
 	if errors.Is(err, ErrNotFound) {
 		return http.StatusNotFound
@@ -154,6 +357,21 @@ func getErrorStatus(err error) int {
 	if errors.Is(err, ErrInvalidReq) {
 		return http.StatusBadRequest
 	}
+	if errors.Is(err, ErrMethodNotAllowed) {
+		return http.StatusMethodNotAllowed
+	}
+	if errors.Is(err, ErrNotAcceptable) {
+		return http.StatusNotAcceptable
+	}
+	if errors.Is(err, ErrTooManyRequests) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, ErrForbidden) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		return http.StatusUnauthorized
+	}
 	return http.StatusInternalServerError
 }
 
@@ -169,56 +387,237 @@ func writeError(ctx context.Context, log *klog.LevelLogger, w http.ResponseWrite
 	headers := w.Header()
 	headers.Del(headerCacheControl)
 	headers.Del(headerContentEncoding)
+	headers.Del(headerContentLanguage)
 	headers.Del(headerContentType)
 	headers.Del(headerETag)
 	headers.Del(headerVary)
 
+	if ew, ok := w.(*errorPageWriter); ok {
+		for _, i := range ew.resHeaders {
+			headers.Del(i)
+		}
+		for _, i := range ew.vary {
+			headers.Add(headerVary, i)
+		}
+		ew.writeError(ctx, log, status)
+		return
+	}
 	http.Error(w, http.StatusText(status), status)
 }
 
-func detectEncoding(dir fs.FS, encodings []Encoding, reqHeaders http.Header, name string) (string, fs.FileInfo, string, error) {
-	encodingsSet := map[string]struct{}{}
-	if accept := strings.TrimSpace(reqHeaders.Get(headerAcceptEncoding)); accept != "" {
-		for _, directive := range strings.Split(accept, ",") {
-			enc, _, _ := strings.Cut(directive, ";")
-			enc = strings.TrimSpace(enc)
-			encodingsSet[enc] = struct{}{}
+// localizedName returns the name of a localized sibling of a file, with the
+// language tag inserted before the file extension
+func localizedName(name string, language string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + language + ext
+}
+
+// detectLanguage selects the localized sibling of a file with the highest
+// client weight that may be served in an acceptable encoding. A language from
+// the override query param or cookie is tried first, and the default language
+// is tried after all acceptable languages. The original file is served when no
+// localized file may be served.
+func detectLanguage(dir fs.FS, route Route, r *http.Request, name string, ctype string) (string, string, error) {
+	l := route.Localize
+	var candidates []string
+	if l.Query != "" {
+		if v := r.URL.Query().Get(l.Query); v != "" {
+			candidates = append(candidates, v)
 		}
 	}
-	for _, i := range encodings {
-		_, ok := encodingsSet[i.Code]
-		if !ok {
+	if l.Cookie != "" {
+		if c, err := r.Cookie(l.Cookie); err == nil && c.Value != "" {
+			candidates = append(candidates, c.Value)
+		}
+	}
+	candidates = append(candidates, parseAcceptLanguage(r.Header).rank(l.Languages)...)
+	if l.Default != "" {
+		candidates = append(candidates, l.Default)
+	}
+	accept := parseAcceptEncoding(r.Header)
+	for _, i := range candidates {
+		language := ""
+		for _, j := range l.Languages {
+			if strings.EqualFold(i, j) {
+				language = j
+				break
+			}
+		}
+		if language == "" {
 			continue
 		}
+		alt := localizedName(name, language)
+		if _, err := detectEncoding(dir, route, accept, alt, ctype); err != nil {
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrNotAcceptable) {
+				continue
+			}
+			return "", "", err
+		}
+		return alt, language, nil
+	}
+	return name, "", nil
+}
+
+// hasVariants returns if any variant may be selected for a file
+func hasVariants(variants []Variant, name string) bool {
+	for _, i := range variants {
+		if i.match == nil || i.match.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectVariant selects the variant of a file with the highest client weight
+// for its content type. Ties are broken by the order of route variants,
+// followed by the original file, which is also served when no variant is
+// acceptable.
+func detectVariant(dir fs.FS, variants []Variant, accept acceptMediaTypes, name string, ctype string) (string, string, error) {
+	if !accept.present {
+		return name, ctype, nil
+	}
+	bestName := name
+	bestCtype := ctype
+	bestQ := accept.weight(ctype)
+	isVariant := false
+	for _, i := range variants {
 		if i.match != nil {
 			if !i.match.MatchString(name) {
 				continue
 			}
 		}
+		q := accept.weight(i.ContentType)
+		if q == 0 || q < bestQ || isVariant && q == bestQ {
+			continue
+		}
 		alt := name + i.Ext
 		stat, err := fs.Stat(dir, alt)
 		if err != nil {
 			if errors.Is(err, fs.ErrNotExist) {
 				continue
 			}
-			return "", nil, "", kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", alt))
+			return "", "", kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", alt))
 		}
 		if stat.IsDir() {
 			continue
 		}
-		return alt, stat, i.Code, nil
+		bestName = alt
+		bestCtype = i.ContentType
+		bestQ = q
+		isVariant = true
+	}
+	return bestName, bestCtype, nil
+}
+
+// isEncodedFile returns if a file is a precompressed encoding of another file
+func isEncodedFile(dir fs.FS, route Route, name string) (bool, error) {
+	for _, i := range route.Encodings {
+		base, ok := strings.CutSuffix(name, i.Ext)
+		if !ok || base == "" {
+			continue
+		}
+		if i.match != nil {
+			if !i.match.MatchString(base) {
+				continue
+			}
+		}
+		stat, err := fs.Stat(dir, base)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return false, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", base))
+		}
+		if !stat.IsDir() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type (
+	encodingCandidate struct {
+		path     string
+		stat     fs.FileInfo
+		encoding string
+		dynamic  bool
+		q        int
+	}
+)
+
+// detectEncoding selects the file variant with the highest client weight.
+// Ties are broken by the order of route encodings, followed by dynamic
+// compression codes, followed by identity.
+func detectEncoding(dir fs.FS, route Route, accept acceptEncodings, name string, ctype string) (*encodingCandidate, error) {
+	var best *encodingCandidate
+	for _, i := range route.Encodings {
+		if i.match != nil {
+			if !i.match.MatchString(name) {
+				continue
+			}
+		}
+		q := accept.weight(i.Code)
+		if q == 0 || best != nil && q <= best.q {
+			continue
+		}
+		alt := name + i.Ext
+		stat, err := fs.Stat(dir, alt)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", alt))
+		}
+		if stat.IsDir() {
+			continue
+		}
+		best = &encodingCandidate{
+			path:     alt,
+			stat:     stat,
+			encoding: i.Code,
+			q:        q,
+		}
 	}
 	stat, err := fs.Stat(dir, name)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			return "", nil, "", kerrors.WithKind(err, ErrNotFound, fmt.Sprintf("File not found: %s", name))
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", name))
 		}
-		return "", nil, "", kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", name))
+		if best != nil {
+			return best, nil
+		}
+		return nil, kerrors.WithKind(err, ErrNotFound, fmt.Sprintf("File not found: %s", name))
 	}
 	if stat.IsDir() {
-		return "", nil, "", kerrors.WithKind(nil, ErrInvalidReq, fmt.Sprintf("File %s is a directory", name))
+		return nil, kerrors.WithKind(nil, ErrInvalidReq, fmt.Sprintf("File %s is a directory", name))
+	}
+	if compressible(route.Compress, ctype, stat.Size()) {
+		for _, i := range route.Compress.Codes {
+			q := accept.weight(i)
+			if q == 0 || best != nil && q <= best.q {
+				continue
+			}
+			best = &encodingCandidate{
+				path:     name,
+				stat:     stat,
+				encoding: i,
+				dynamic:  true,
+				q:        q,
+			}
+		}
 	}
-	return name, stat, "", nil
+	if q := accept.weight(encodingIdentity); q != 0 && (best == nil || q > best.q) {
+		best = &encodingCandidate{
+			path:     name,
+			stat:     stat,
+			encoding: "",
+			q:        q,
+		}
+	}
+	if best == nil {
+		return nil, kerrors.WithKind(nil, ErrNotAcceptable, fmt.Sprintf("No acceptable encoding for file %s", name))
+	}
+	return best, nil
 }
 
 const (
@@ -256,16 +655,44 @@ func getFileConfig(
 	ctx context.Context,
 	log *klog.LevelLogger,
 	dir fs.FS,
-	reqHeaders http.Header,
+	r *http.Request,
 	name string,
 	route Route,
 ) (*fileConfig, error) {
+	reqHeaders := r.Header
 	ctype := detectContentType(name, route.DefaultContentType)
+	headers := routeHeaders(route, name)
+	reqName := name
+
+	var vary []string
+	basename := path.Base(name)
+	var language string
+	if len(route.Localize.Languages) > 0 {
+		vary = append(vary, headerAcceptLanguage)
+		if route.Localize.Cookie != "" {
+			vary = append(vary, headerCookie)
+		}
+		var err error
+		name, language, err = detectLanguage(dir, route, r, name, ctype)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hasVariants(route.Variants, name) {
+		vary = append(vary, headerAccept)
+		var err error
+		name, ctype, err = detectVariant(dir, route.Variants, parseAcceptMediaTypes(reqHeaders), name, ctype)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	p, stat, encoding, err := detectEncoding(dir, route.Encodings, reqHeaders, name)
+	candidate, err := detectEncoding(dir, route, parseAcceptEncoding(reqHeaders), name, ctype)
 	if err != nil {
 		return nil, err
 	}
+	p := candidate.path
+	stat := candidate.stat
 
 	currentTag := statToTag(stat)
 	var checksum string
@@ -281,26 +708,88 @@ func getFileConfig(
 			if xattrChecksum == "" {
 				xattrChecksum = defaultXAttrChecksum
 			}
+			metrics := getCtxMetrics(ctx)
 			if hash, tag, err := readChecksumXAttr(xattrChecksum, fullFilePath); err != nil {
+				metrics.observeXAttr(xattrResultError)
 				log.Err(ctx, err, klog.AString("path", p))
 			} else if tag == currentTag {
+				metrics.observeXAttr(xattrResultHit)
 				checksum = hash
 			} else {
+				if hash == "" {
+					metrics.observeXAttr(xattrResultMiss)
+				} else {
+					metrics.observeXAttr(xattrResultStale)
+				}
 				log.Warn(ctx, "File checksum tags differ", klog.AString("path", p))
 			}
 		}
 	}
 
 	return &fileConfig{
-		path:     p,
-		basename: path.Base(name),
-		ctype:    ctype,
-		encoding: encoding,
-		checksum: checksum,
-		tag:      currentTag,
+		path:         p,
+		basename:     basename,
+		ctype:        ctype,
+		encoding:     candidate.encoding,
+		language:     language,
+		dynamic:      candidate.dynamic,
+		checksum:     checksum,
+		tag:          currentTag,
+		modtime:      stat.ModTime(),
+		cachecontrol: routeCacheControl(route, reqName),
+		vary:         vary,
+		headers:      headers,
 	}, nil
 }
 
+// routeCacheControl returns the Cache-Control of the first rule of a route
+// matching a file
+func routeCacheControl(route Route, name string) string {
+	for _, i := range route.CacheControlRules {
+		if i.match.MatchString(name) {
+			return i.CacheControl
+		}
+	}
+	return route.CacheControl
+}
+
+// routeHeaders returns the headers of the rules of a route matching a file
+func routeHeaders(route Route, name string) http.Header {
+	var headers http.Header
+	for _, i := range route.Headers {
+		if i.match != nil && !i.match.MatchString(name) {
+			continue
+		}
+		if headers == nil {
+			headers = http.Header{}
+		}
+		for k, v := range i.headers {
+			headers[k] = v
+		}
+	}
+	return headers
+}
+
+// mergeHeaders returns headers with the values of override taking precedence
+func mergeHeaders(headers, override http.Header) http.Header {
+	if len(override) == 0 {
+		return headers
+	}
+	if len(headers) == 0 {
+		return override
+	}
+	res := headers.Clone()
+	for k, v := range override {
+		res[k] = v
+	}
+	return res
+}
+
+const (
+	// etagEncodingSeparator is not in the base64 url alphabet
+	etagEncodingSeparator = "."
+)
+
 func calcWeakETag(tag string) string {
 	return `W/"` + tag + `"`
 }
@@ -309,49 +798,84 @@ func calcStrongETag(tag string) string {
 	return `"` + tag + `"`
 }
 
-func writeResHeaders(w http.ResponseWriter, reqHeaders http.Header, cfg fileConfig, cachecontrol string) bool {
+// matchIfNoneMatch returns the first If-None-Match entity tag equal to one of
+// etags
+func matchIfNoneMatch(reqHeaders http.Header, etags ...string) (string, bool) {
+	match := strings.TrimSpace(reqHeaders.Get(headerIfNoneMatch))
+	if match == "" {
+		return "", false
+	}
+	for _, tag := range strings.Split(match, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if slices.Contains(etags, tag) {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+func writeResHeaders(w http.ResponseWriter, reqHeaders http.Header, cfg fileConfig) bool {
 	// According to RFC7232 section 4.1, server must send same Cache-Control,
 	// Content-Location, Date, ETag, Expires, and Vary headers for 304 response
 	// as 200 response.
 	w.Header().Add(headerVary, headerAcceptEncoding)
+	for _, i := range cfg.vary {
+		w.Header().Add(headerVary, i)
+	}
+	ew, _ := w.(*errorPageWriter)
+	for k, v := range cfg.headers {
+		w.Header()[k] = slices.Clone(v)
+		if ew != nil {
+			// headers of the file are removed from error responses
+			ew.resHeaders = append(ew.resHeaders, k)
+		}
+	}
 
-	if cachecontrol != "" {
-		w.Header().Set(headerCacheControl, cachecontrol)
-
-		// ETag used by [net/http.ServeContent] for byte range requests
-		// strong etag allows serving range queries
-		// weak etag does not allow range queries
-		if cfg.tag != "" {
-			weakETag := calcWeakETag(cfg.tag)
-			var strongETag string
-			if cfg.checksum != "" {
-				strongETag = calcStrongETag(cfg.checksum)
-			}
-			if match := strings.TrimSpace(reqHeaders.Get(headerIfNoneMatch)); match != "" {
-				for _, tag := range strings.Split(match, ",") {
-					tag = strings.TrimSpace(tag)
-					if tag == "" {
-						continue
-					}
-					if tag == strongETag || tag == weakETag {
-						w.Header().Set(headerETag, tag)
-						w.WriteHeader(http.StatusNotModified)
-						return true
-					}
-				}
-			}
+	if cfg.cachecontrol != "" {
+		w.Header().Set(headerCacheControl, cfg.cachecontrol)
+	}
 
-			if strongETag != "" {
-				w.Header().Set(headerETag, strongETag)
-			} else {
-				w.Header().Set(headerETag, weakETag)
+	// ETag used by [net/http.ServeContent] for byte range requests
+	// strong etag allows serving range queries
+	// weak etag does not allow range queries
+	if cfg.tag != "" {
+		tag := cfg.tag
+		checksum := cfg.checksum
+		if cfg.dynamic {
+			// dynamically compressed bodies are a different representation of
+			// the file per encoding
+			tag += etagEncodingSeparator + cfg.encoding
+			if checksum != "" {
+				checksum += etagEncodingSeparator + cfg.encoding
 			}
 		}
+		weakETag := calcWeakETag(tag)
+		var strongETag string
+		if checksum != "" {
+			strongETag = calcStrongETag(checksum)
+		}
+		if tag, ok := matchIfNoneMatch(reqHeaders, strongETag, weakETag); ok {
+			w.Header().Set(headerETag, tag)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+
+		if strongETag != "" {
+			w.Header().Set(headerETag, strongETag)
+		} else {
+			w.Header().Set(headerETag, weakETag)
+		}
 	}
 
 	if cfg.encoding != "" {
 		w.Header().Set(headerContentEncoding, cfg.encoding)
 	}
+	if cfg.language != "" {
+		w.Header().Set(headerContentLanguage, cfg.language)
+	}
 	w.Header().Set(headerContentType, cfg.ctype)
 	return false
 }
@@ -395,6 +919,31 @@ func sendFile(
 	http.ServeContent(w, r, cfg.basename, stat.ModTime(), rsf)
 }
 
+func sendCompressedFile(
+	ctx context.Context,
+	log *klog.LevelLogger,
+	dir fs.FS,
+	w http.ResponseWriter,
+	r *http.Request,
+	cfg fileConfig,
+	key string,
+	compress *compressCache,
+) {
+	body, err := compress.get(ctx, key, func() ([]byte, error) {
+		return compressFile(dir, cfg)
+	})
+	if err != nil {
+		writeError(ctx, log, w, err)
+		return
+	}
+	defer func() {
+		if err := body.close(); err != nil {
+			log.Err(ctx, kerrors.WithMsg(err, fmt.Sprintf("Failed to close compressed file %s", cfg.path)))
+		}
+	}()
+	http.ServeContent(w, r, cfg.basename, cfg.modtime, body.r)
+}
+
 func serveFile(
 	log *klog.LevelLogger,
 	dir fs.FS,
@@ -402,6 +951,7 @@ func serveFile(
 	r *http.Request,
 	name string,
 	route Route,
+	compress *compressCache,
 ) {
 	ctx := r.Context()
 
@@ -410,135 +960,305 @@ func serveFile(
 		return
 	}
 
-	cfg, err := getFileConfig(ctx, log, dir, r.Header, name, route)
+	cfg, err := getFileConfig(ctx, log, dir, r, name, route)
 	if err != nil {
 		writeError(ctx, log, w, err)
 		return
 	}
 
-	if writeResHeaders(w, r.Header, *cfg, route.CacheControl) {
-		return
-	}
-
-	sendFile(ctx, log, dir, w, r, *cfg)
+	serveFileConfig(log, dir, w, r, *cfg, route, compress)
 }
 
-type (
-	resDirEntry struct {
-		Name string `json:"name"`
-		Dir  bool   `json:"dir,omitempty"`
-	}
-
-	resDirListing struct {
-		Entries []resDirEntry `json:"entries"`
-	}
-)
-
-func serveDir(
+func serveFileConfig(
 	log *klog.LevelLogger,
 	dir fs.FS,
 	w http.ResponseWriter,
 	r *http.Request,
-	dirName string,
+	cfg fileConfig,
 	route Route,
+	compress *compressCache,
 ) {
 	ctx := r.Context()
 
-	if !route.DirList {
-		writeError(ctx, log, w, kerrors.WithKind(nil, ErrInvalidReq, "Dir listing not supported"))
+	if writeResHeaders(w, r.Header, cfg) {
 		return
 	}
 
-	if dirName == "" {
-		dirName = "."
+	if cfg.dynamic {
+		sendCompressedFile(ctx, log, dir, w, r, cfg, compressCacheKey(route.Prefix, cfg), compress)
+		return
 	}
 
-	stat, err := fs.Stat(dir, dirName)
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			writeError(ctx, log, w, kerrors.WithKind(err, ErrNotFound, fmt.Sprintf("Dir not found: %s", dirName)))
-			return
+	sendFile(ctx, log, dir, w, r, cfg)
+}
+
+func routeMatchPath(route Route, name string) bool {
+	if route.include != nil {
+		if !route.include.MatchString(name) {
+			return false
 		}
-		writeError(ctx, log, w, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat dir %s", dirName)))
-		return
 	}
-	if !stat.IsDir() {
-		writeError(ctx, log, w, kerrors.WithKind(nil, ErrInvalidReq, fmt.Sprintf("Path %s is not a directory", dirName)))
-		return
+	if route.exclude != nil {
+		if route.exclude.MatchString(name) {
+			return false
+		}
 	}
+	return true
+}
 
-	entries, err := fs.ReadDir(dir, dirName)
-	if err != nil {
-		fmt.Println("err", err)
-		writeError(ctx, log, w, kerrors.WithMsg(err, fmt.Sprintf("Failed to read dir: %s", dirName)))
-		return
+// isNavigationRequest returns if a request is likely a browser navigation
+func isNavigationRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
 	}
+	if mode := r.Header.Get(headerSecFetchMode); mode != "" {
+		return mode == "navigate"
+	}
+	for _, i := range parseAccept(r.Header.Values(headerAccept)) {
+		if i.value == mediaTypeHTML && i.q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectRelative redirects to a target relative to the request path, since
+// the route prefix has been stripped from the request url
+func redirectRelative(w http.ResponseWriter, r *http.Request, target string) {
+	u := url.URL{
+		Path:     target,
+		RawQuery: r.URL.RawQuery,
+	}
+	w.Header().Set(headerLocation, u.String())
+	w.WriteHeader(http.StatusMovedPermanently)
+}
 
-	var listing []resDirEntry
-	for _, i := range entries {
-		fname := i.Name()
-		isDir := i.IsDir()
-		if !routeMatchPath(route, path.Join(dirName, fname)) {
+// resolveFile returns the config of the first of names that exists and is
+// served by the route
+func (s *serverSubdir) resolveFile(r *http.Request, names []string) (*fileConfig, error) {
+	ctx := r.Context()
+	err := kerrors.WithKind(nil, ErrNotFound, "No index file found")
+	for _, i := range names {
+		if s.route.ControlFiles && isControlFile(i) {
+			err = kerrors.WithKind(nil, ErrNotFound, fmt.Sprintf("File is a control file: %s", i))
 			continue
 		}
-		listing = append(listing, resDirEntry{
-			Name: fname,
-			Dir:  isDir,
-		})
+		if !routeMatchPath(s.route, i) {
+			err = kerrors.WithKind(nil, ErrNotFound, fmt.Sprintf("File is not included: %s", i))
+			continue
+		}
+		if s.route.DenyEncoded {
+			if ok, err := isEncodedFile(s.dir, s.route, i); err != nil {
+				return nil, err
+			} else if ok {
+				return nil, kerrors.WithKind(nil, ErrNotFound, fmt.Sprintf("File is an encoded variant: %s", i))
+			}
+		}
+		var cfg *fileConfig
+		cfg, err = getFileConfig(ctx, s.log, s.dir, r, i, s.route)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		return cfg, nil
 	}
+	return nil, err
+}
 
-	b, err := kjson.Marshal(resDirListing{Entries: listing})
-	if err != nil {
-		writeError(ctx, log, w, kerrors.WithMsg(err, fmt.Sprintf("Failed to encode dir listing: %s", dirName)))
+func (s *serverSubdir) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ew := s.errorPages.wrap(w, r)
+	w = ew
+	if err := checkIPFilter(s.log, r, s.route.Prefix, s.route.IPFilter); err != nil {
+		writeError(ctx, s.log, w, err)
 		return
 	}
-
-	w.Header().Set(headerContentType, "application/json")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(b); err != nil {
-		writeError(ctx, log, w, kerrors.WithMsg(err, fmt.Sprintf("Failed writing http res for dir: %s", dirName)))
+	if err := s.limiter.checkRateLimit(w, r, "route "+s.route.Prefix, s.route.RateLimit); err != nil {
+		writeError(ctx, s.log, w, err)
 		return
 	}
-}
-
-func routeMatchPath(route Route, name string) bool {
-	if route.include != nil {
-		if !route.include.MatchString(name) {
-			return false
+	if serveCORS(ew, r, s.route.CORS) {
+		return
+	}
+	if err := checkClientCert(r, s.route.Prefix, s.route.ClientCert); err != nil {
+		writeError(ctx, s.log, w, err)
+		return
+	}
+	r2, err := s.route.Auth.authenticate(w, r)
+	if err != nil {
+		writeError(ctx, s.log, w, err)
+		return
+	}
+	r = r2
+	ctx = r.Context()
+	if s.route.Signed {
+		if err := verifySignedURL(s.signKey, r, time.Now()); err != nil {
+			writeError(ctx, s.log, w, err)
+			return
 		}
 	}
-	if route.exclude != nil {
-		if route.exclude.MatchString(name) {
-			return false
+
+	name := r.URL.Path
+	hasSlash := name == "" || strings.HasSuffix(name, "/")
+	name = strings.TrimSuffix(name, "/")
+
+	var headers http.Header
+	if s.control != nil {
+		p := "/" + r.URL.Path
+		headers = s.control.matchHeaders(p)
+		statName := name
+		if statName == "" {
+			statName = "."
+		}
+		rule, target, err := s.control.matchRedirect(s.dir, p, statName)
+		if err != nil {
+			writeError(ctx, s.log, w, err)
+			return
+		}
+		if rule != nil {
+			if rule.Status != http.StatusOK {
+				if strings.HasPrefix(target, "/") {
+					target = strings.TrimSuffix(s.route.Prefix, "/") + target
+				}
+				http.Redirect(w, r, withQuery(target, r.URL), rule.Status)
+				return
+			}
+			r2, err := rewriteRequest(r, target)
+			if err != nil {
+				writeError(ctx, s.log, w, err)
+				return
+			}
+			r = r2
+			name = strings.TrimPrefix(r.URL.Path, "/")
+			hasSlash = name == "" || strings.HasSuffix(name, "/")
+			name = strings.TrimSuffix(name, "/")
 		}
 	}
-	return true
-}
 
-func (s *serverSubdir) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("dir") == "t" {
-		serveDir(s.log, s.dir, w, r, r.URL.Path, s.route)
+		serveDir(s.log, s.dir, w, r, name, s.route)
+		return
+	}
+
+	isDir := name == ""
+	if !isDir {
+		stat, err := fs.Stat(s.dir, name)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				writeError(ctx, s.log, w, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", name)))
+				return
+			}
+		} else {
+			isDir = stat.IsDir()
+		}
+	}
+
+	names := []string{name}
+	if isDir {
+		if !hasSlash && s.route.TrailingSlash == trailingSlashAdd {
+			redirectRelative(w, r, path.Base(name)+"/")
+			return
+		}
+		if len(s.route.Index) == 0 {
+			writeError(ctx, s.log, w, kerrors.WithKind(nil, ErrInvalidReq, fmt.Sprintf("File %s is a directory", name)))
+			return
+		}
+		names = make([]string, 0, len(s.route.Index))
+		for _, i := range s.route.Index {
+			names = append(names, path.Join(name, i))
+		}
+	} else if hasSlash {
+		if s.route.TrailingSlash == trailingSlashStrip {
+			redirectRelative(w, r, "../"+path.Base(name))
+			return
+		}
+		writeError(ctx, s.log, w, kerrors.WithKind(nil, ErrNotFound, fmt.Sprintf("File %s is not a directory", name)))
 		return
 	}
 
-	if !routeMatchPath(s.route, r.URL.Path) {
-		writeError(r.Context(), s.log, w, kerrors.WithKind(nil, ErrNotFound, fmt.Sprintf("File is not included: %s", r.URL.Path)))
+	cfg, err := s.resolveFile(r, names)
+	if err != nil {
+		if s.route.Fallback == "" || !errors.Is(err, ErrNotFound) || !isNavigationRequest(r) {
+			writeError(ctx, s.log, w, err)
+			return
+		}
+		cfg, err = getFileConfig(ctx, s.log, s.dir, r, s.route.Fallback, s.route)
+		if err != nil {
+			writeError(ctx, s.log, w, err)
+			return
+		}
+		for _, i := range []string{headerAccept, headerSecFetchMode} {
+			if !slices.Contains(cfg.vary, i) {
+				cfg.vary = append(cfg.vary, i)
+			}
+		}
+		cfg.headers = mergeHeaders(cfg.headers, headers)
+		cfg.cachecontrol = s.route.FallbackCacheControl
+		serveFileConfig(s.log, s.dir, w, r, *cfg, s.route, s.compress)
 		return
 	}
-	serveFile(s.log, s.dir, w, r, r.URL.Path, s.route)
+	cfg.headers = mergeHeaders(cfg.headers, headers)
+	serveFileConfig(s.log, s.dir, w, r, *cfg, s.route, s.compress)
 }
 
 func (s *serverFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ew := s.errorPages.wrap(w, r)
+	w = ew
+	if err := checkIPFilter(s.log, r, s.route.Prefix, s.route.IPFilter); err != nil {
+		writeError(r.Context(), s.log, w, err)
+		return
+	}
+	if err := s.limiter.checkRateLimit(w, r, "route "+s.route.Prefix, s.route.RateLimit); err != nil {
+		writeError(r.Context(), s.log, w, err)
+		return
+	}
+	if serveCORS(ew, r, s.route.CORS) {
+		return
+	}
+	if err := checkClientCert(r, s.route.Prefix, s.route.ClientCert); err != nil {
+		writeError(r.Context(), s.log, w, err)
+		return
+	}
+	r2, err := s.route.Auth.authenticate(w, r)
+	if err != nil {
+		writeError(r.Context(), s.log, w, err)
+		return
+	}
+	r = r2
+	if s.route.Signed {
+		if err := verifySignedURL(s.signKey, r, time.Now()); err != nil {
+			writeError(r.Context(), s.log, w, err)
+			return
+		}
+	}
 	// may not use url path here to prevent unwanted file access
-	serveFile(s.log, s.dir, w, r, s.route.Path, s.route)
+	serveFile(s.log, s.dir, w, r, s.route.Path, s.route, s.compress)
 }
 
 func NewServer(l klog.Logger, dir fs.FS, config Config) *Server {
+	state := &atomic.Pointer[serverState]{}
+	state.Store(&serverState{
+		mux:     http.NewServeMux(),
+		routes:  nil,
+		proxies: config.Proxies,
+		globals: Globals{
+			ErrorPages: config.ErrorPages,
+			IPFilter:   config.IPFilter,
+			RateLimit:  config.RateLimit,
+			AccessLog:  config.AccessLog,
+		},
+	})
+	log := klog.NewLevelLogger(l)
 	return &Server{
-		log:      klog.NewLevelLogger(l),
+		log:      log,
 		dir:      dir,
-		mux:      http.NewServeMux(),
+		state:    state,
 		config:   config,
+		compress: newCompressCache(log, config.CompressCache),
+		limiter:  newRateLimiter(),
+		metrics:  newServerMetrics(),
 		reqcount: &atomic.Uint32{},
 	}
 }
@@ -561,6 +1281,99 @@ func parseRoutes(routes []Route) error {
 				}
 			}
 		}
+		if err := parseCompression(&routes[n].Compress, i.Prefix); err != nil {
+			return err
+		}
+		if err := parseCORS(&routes[n].CORS, i.Prefix); err != nil {
+			return err
+		}
+		if err := parseIPFilter(&routes[n].IPFilter, "route "+i.Prefix); err != nil {
+			return err
+		}
+		if err := parseRateLimit(&routes[n].RateLimit, "route "+i.Prefix); err != nil {
+			return err
+		}
+		for m, j := range i.CacheControlRules {
+			if j.Match == "" {
+				return kerrors.WithMsg(nil, fmt.Sprintf("Missing cache control rule match for route %s", i.Prefix))
+			}
+			var err error
+			i.CacheControlRules[m].match, err = regexp.Compile(j.Match)
+			if err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Invalid cache control rule match regex %s for route %s", j.Match, i.Prefix))
+			}
+		}
+		for m, j := range i.Headers {
+			if j.Match != "" {
+				var err error
+				i.Headers[m].match, err = regexp.Compile(j.Match)
+				if err != nil {
+					return kerrors.WithMsg(err, fmt.Sprintf("Invalid header rule match regex %s for route %s", j.Match, i.Prefix))
+				}
+			}
+			headers := make(http.Header, len(j.Headers))
+			for k, v := range j.Headers {
+				if k == "" || strings.ContainsAny(k, " :\r\n") || strings.ContainsAny(v, "\r\n") {
+					return kerrors.WithMsg(nil, fmt.Sprintf("Invalid header %q for route %s", k, i.Prefix))
+				}
+				headers.Set(k, v)
+			}
+			i.Headers[m].headers = headers
+		}
+		if i.ControlFiles && !i.Dir {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Control files require a dir route %s", i.Prefix))
+		}
+		switch i.TrailingSlash {
+		case "", trailingSlashAdd, trailingSlashStrip:
+		default:
+			return kerrors.WithMsg(nil, fmt.Sprintf("Invalid trailing slash policy %s for route %s", i.TrailingSlash, i.Prefix))
+		}
+		for _, j := range i.Index {
+			if j == "" || strings.Contains(j, "/") {
+				return kerrors.WithMsg(nil, fmt.Sprintf("Invalid index file %q for route %s", j, i.Prefix))
+			}
+		}
+		if i.Fallback != "" && !fs.ValidPath(i.Fallback) {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Invalid fallback file %s for route %s", i.Fallback, i.Prefix))
+		}
+		if i.DirListLimit < 0 || i.DirListMaxDepth < 0 {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Invalid dir list limit or max depth for route %s", i.Prefix))
+		}
+		if pages, err := parseErrorPages(i.ErrorPages); err != nil {
+			return kerrors.WithMsg(err, fmt.Sprintf("Invalid error pages for route %s", i.Prefix))
+		} else {
+			routes[n].errorPages = pages
+		}
+		if i.DirListTemplate != "" {
+			var err error
+			routes[n].dirListTemplate, err = parseDirListTemplate(i.DirListTemplate)
+			if err != nil {
+				return kerrors.WithMsg(err, fmt.Sprintf("Invalid dir list template for route %s", i.Prefix))
+			}
+		}
+		for _, j := range i.Localize.Languages {
+			if j == "" || strings.ContainsAny(j, "./") {
+				return kerrors.WithMsg(nil, fmt.Sprintf("Invalid localize language %q for route %s", j, i.Prefix))
+			}
+		}
+		if i.Localize.Default != "" && !slices.Contains(i.Localize.Languages, i.Localize.Default) {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Localize default language %s is not a language of route %s", i.Localize.Default, i.Prefix))
+		}
+		for m, j := range i.Variants {
+			if j.ContentType == "" {
+				return kerrors.WithMsg(nil, fmt.Sprintf("Missing variant content type for route %s", i.Prefix))
+			}
+			if j.Ext == "" {
+				return kerrors.WithMsg(nil, fmt.Sprintf("Missing variant ext for content type %s of route %s", j.ContentType, i.Prefix))
+			}
+			if j.Match != "" {
+				var err error
+				i.Variants[m].match, err = regexp.Compile(j.Match)
+				if err != nil {
+					return kerrors.WithMsg(err, fmt.Sprintf("Invalid variant match regex for content type %s of route %s", j.ContentType, i.Prefix))
+				}
+			}
+		}
 		for m, j := range i.Encodings {
 			if j.Code == "" {
 				return kerrors.WithMsg(nil, fmt.Sprintf("Missing encoding code for route %s", i.Prefix))
@@ -577,57 +1390,249 @@ func parseRoutes(routes []Route) error {
 	return nil
 }
 
-func (s *Server) Mount(routes []Route) error {
+func (s *Server) buildState(routes []Route, rules Rules, proxies []netip.Prefix, globals Globals) (*serverState, error) {
 	if err := parseRoutes(routes); err != nil {
-		return err
+		return nil, err
+	}
+	if support := s.clientCerts.Load(); support != nil {
+		if err := support.checkRoutes(routes); err != nil {
+			return nil, err
+		}
+	}
+	if err := parseRules(rules); err != nil {
+		return nil, err
+	}
+	if err := ValidateMimeTypes(globals.MimeTypes); err != nil {
+		return nil, kerrors.WithMsg(err, "Invalid mime types")
+	}
+
+	defaultErrorPages, err := newDefaultErrorPages(s.dir, globals.ErrorPages)
+	if err != nil {
+		return nil, err
 	}
 
-	s.mux = http.NewServeMux()
+	ipFilter := globals.IPFilter
+	if err := parseIPFilter(&ipFilter, scopeGlobal); err != nil {
+		return nil, err
+	}
+
+	rateLimit := globals.RateLimit
+	if err := parseRateLimit(&rateLimit, scopeGlobal); err != nil {
+		return nil, err
+	}
+
+	accessLog, err := parseAccessLog(globals.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	hasRoot := false
 	for _, i := range routes {
+		if i.Prefix == "/" {
+			hasRoot = true
+		}
 		s.log.Info(context.Background(), "Handle route",
 			klog.AString("route.prefix", i.Prefix),
 			klog.AString("route.fspath", i.Path),
 			klog.ABool("route.dir", i.Dir),
 		)
 		log := klog.NewLevelLogger(s.log.Logger.Sublogger("router", klog.AString("router.path", i.Prefix)))
+		limitCompressSize(&i.Compress, s.config.CompressCache.MaxSize)
+		if i.Auth.enabled() {
+			if err := loadAuth(&i.Auth, i.Prefix); err != nil {
+				return nil, err
+			}
+		}
+		if i.Signed {
+			if err := validateSignKey(s.config.SignKey); err != nil {
+				return nil, kerrors.WithMsg(err, fmt.Sprintf("Signed route %s requires a signing key", i.Prefix))
+			}
+		}
 		if i.Dir {
 			dir, err := fs.Sub(s.dir, i.Path)
 			if err != nil {
-				return kerrors.WithMsg(err, fmt.Sprintf("Failed to open subdir %s", i.Path))
+				return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to open subdir %s", i.Path))
+			}
+			var control *controlFiles
+			if i.ControlFiles {
+				control, err = loadControlFiles(dir)
+				if err != nil {
+					return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to load control files for route %s", i.Prefix))
+				}
+			}
+			if err := handleRoute(mux, i.Prefix, http.StripPrefix(i.Prefix, &serverSubdir{
+				log:      log,
+				dir:      dir,
+				route:    i,
+				compress: s.compress,
+				errorPages: &errorPageSet{
+					dir:   dir,
+					route: i,
+					next:  defaultErrorPages,
+				},
+				control: control,
+				limiter: s.limiter,
+				signKey: s.config.SignKey,
+			})); err != nil {
+				return nil, err
 			}
-			s.mux.Handle(i.Prefix, http.StripPrefix(i.Prefix, &serverSubdir{
-				log:   log,
-				dir:   dir,
-				route: i,
-			}))
 		} else {
-			s.mux.Handle(i.Prefix, &serverFile{
-				log:   log,
-				dir:   s.dir,
-				route: i,
-			})
+			if err := handleRoute(mux, i.Prefix, &serverFile{
+				log:      log,
+				dir:      s.dir,
+				route:    i,
+				compress: s.compress,
+				errorPages: &errorPageSet{
+					dir:   s.dir,
+					route: i,
+					next:  defaultErrorPages,
+				},
+				limiter: s.limiter,
+				signKey: s.config.SignKey,
+			}); err != nil {
+				return nil, err
+			}
 		}
 	}
+	if !hasRoot {
+		mux.Handle("/", &notFoundHandler{
+			log: s.log,
+		})
+	}
+	return &serverState{
+		mux:        mux,
+		routes:     routes,
+		rules:      rules,
+		proxies:    proxies,
+		errorPages: defaultErrorPages,
+		ipFilter:   ipFilter,
+		rateLimit:  rateLimit,
+		accessLog:  accessLog,
+		globals:    globals,
+	}, nil
+}
+
+// handleRoute registers a route handler, and returns an error instead of
+// panicking on a duplicate or invalid prefix
+func handleRoute(mux *http.ServeMux, prefix string, h http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = kerrors.WithMsg(nil, fmt.Sprintf("Invalid route prefix %s: %v", prefix, r))
+		}
+	}()
+	mux.Handle(prefix, h)
 	return nil
 }
 
+// Mount mounts routes with the current rules, trusted proxies, and globals
+func (s *Server) Mount(routes []Route) error {
+	state := s.state.Load()
+	return s.Reload(routes, state.rules, state.proxies, state.globals)
+}
+
+// Reload validates routes, rules, proxies, and globals and atomically swaps
+// them in. The previous routes continue to be served and no mime types are
+// registered if any of the new config is invalid.
+func (s *Server) Reload(routes []Route, rules Rules, proxies []netip.Prefix, globals Globals) error {
+	state, err := s.buildState(routes, rules, proxies, globals)
+	if err != nil {
+		return err
+	}
+	return s.commitState(state)
+}
+
+// commitState registers the mime types of a validated state and swaps it in
+func (s *Server) commitState(state *serverState) error {
+	if err := AddMimeTypes(state.globals.MimeTypes); err != nil {
+		return err
+	}
+	prev := s.state.Swap(state)
+	s.mounted.Store(true)
+	added, removed, changed := diffRoutes(prev.routes, state.routes)
+	prevRules, _ := kjson.Marshal(prev.rules)
+	nextRules, _ := kjson.Marshal(state.rules)
+	prevGlobals, _ := kjson.Marshal(prev.globals)
+	nextGlobals, _ := kjson.Marshal(state.globals)
+	s.log.Info(context.Background(), "Mounted routes",
+		klog.AAny("routes.added", added),
+		klog.AAny("routes.removed", removed),
+		klog.AAny("routes.changed", changed),
+		klog.ABool("rules.changed", !bytes.Equal(prevRules, nextRules)),
+		klog.ABool("realip.proxies.changed", !slices.Equal(prev.proxies, state.proxies)),
+		klog.ABool("globals.changed", !bytes.Equal(prevGlobals, nextGlobals)),
+	)
+	if removed := removedMimeTypes(prev.globals.MimeTypes, state.globals.MimeTypes); len(removed) > 0 {
+		s.log.Warn(context.Background(), "Removed ext mime types remain registered until restart",
+			klog.AAny("mimetypes.removed", removed),
+		)
+	}
+	return nil
+}
+
+// removedMimeTypes returns the exts of prev which are not in next
+func removedMimeTypes(prev, next []MimeType) []string {
+	var removed []string
+	for _, i := range prev {
+		if !slices.ContainsFunc(next, func(k MimeType) bool {
+			return strings.EqualFold(k.Ext, i.Ext)
+		}) {
+			removed = append(removed, i.Ext)
+		}
+	}
+	return removed
+}
+
+func diffRoutes(prev, next []Route) (added, removed, changed []string) {
+	prevSet := make(map[string][]byte, len(prev))
+	for _, i := range prev {
+		// json encoding compares only exported config fields
+		b, _ := kjson.Marshal(i)
+		prevSet[i.Prefix] = b
+	}
+	nextSet := make(map[string]struct{}, len(next))
+	for _, i := range next {
+		nextSet[i.Prefix] = struct{}{}
+		prevb, ok := prevSet[i.Prefix]
+		if !ok {
+			added = append(added, i.Prefix)
+			continue
+		}
+		b, _ := kjson.Marshal(i)
+		if !bytes.Equal(prevb, b) {
+			changed = append(changed, i.Prefix)
+		}
+	}
+	for _, i := range prev {
+		if _, ok := nextSet[i.Prefix]; !ok {
+			removed = append(removed, i.Prefix)
+		}
+	}
+	return added, removed, changed
+}
+
 const (
 	headerXForwardedFor = "X-Forwarded-For"
 )
 
+// getRealIP returns the client ip of a request from the X-Forwarded-For header
+// set by trusted proxies. Peers of unix socket listeners have no ip and are
+// trusted proxies, since only local processes permitted by the socket file may
+// connect.
 func getRealIP(r *http.Request, proxies []netip.Prefix) string {
-	host, err := netip.ParseAddrPort(strings.TrimSpace(r.RemoteAddr))
-	if err != nil {
+	var remoteip netip.Addr
+	if host, err := netip.ParseAddrPort(strings.TrimSpace(r.RemoteAddr)); err == nil {
+		remoteip = host.Addr()
+		if !ipnetsContain(remoteip, proxies) {
+			return remoteip.String()
+		}
+	} else if !isUnixConn(r) {
 		return ""
 	}
-	remoteip := host.Addr()
-	if !ipnetsContain(remoteip, proxies) {
-		return remoteip.String()
-	}
 
 	xff := r.Header.Get(headerXForwardedFor)
 	if xff == "" {
-		return remoteip.String()
+		return addrString(remoteip)
 	}
 
 	prev := remoteip
@@ -635,7 +1640,7 @@ func getRealIP(r *http.Request, proxies []netip.Prefix) string {
 	for i := len(ipstrs) - 1; i >= 0; i-- {
 		ip, err := netip.ParseAddr(strings.TrimSpace(ipstrs[i]))
 		if err != nil {
-			return remoteip.String()
+			return addrString(remoteip)
 		}
 		if !ipnetsContain(ip, proxies) {
 			return ip.String()
@@ -643,7 +1648,21 @@ func getRealIP(r *http.Request, proxies []netip.Prefix) string {
 		prev = ip
 	}
 
-	return prev.String()
+	return addrString(prev)
+}
+
+// isUnixConn returns if a request was received on a unix socket listener
+func isUnixConn(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == listenerNetworkUnix
+}
+
+// addrString returns an ip string, or the empty string for an unknown ip
+func addrString(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
+	}
+	return ip.String()
 }
 
 func ipnetsContain(ip netip.Addr, ipnet []netip.Prefix) bool {
@@ -698,6 +1717,8 @@ type (
 		w           http.ResponseWriter
 		status      int
 		wroteHeader bool
+		written     uint64
+		route       string
 	}
 )
 
@@ -719,7 +1740,9 @@ func (w *serverResponseWriter) Write(p []byte) (int, error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
-	return w.w.Write(p)
+	n, err := w.w.Write(p)
+	w.written += uint64(n)
+	return n, err
 }
 
 func (w *serverResponseWriter) Unwrap() http.ResponseWriter {
@@ -727,70 +1750,281 @@ func (w *serverResponseWriter) Unwrap() http.ResponseWriter {
 }
 
 var allowedHTTPMethods = map[string]struct{}{
-	http.MethodGet:  {},
-	http.MethodHead: {},
+	http.MethodGet:     {},
+	http.MethodHead:    {},
+	http.MethodOptions: {},
 }
 
-func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+func (h *notFoundHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeError(r.Context(), h.log, w, kerrors.WithKind(nil, ErrNotFound, "No route found"))
+}
+
+func (s *Server) handleHTTP(state *serverState, w2 *serverResponseWriter, r *http.Request) {
+	w := state.errorPages.wrap(w2, r)
+	if err := checkIPFilter(s.log, r, "", state.ipFilter); err != nil {
+		writeError(r.Context(), s.log, w, err)
+		return
+	}
+	if err := s.limiter.checkRateLimit(w, r, scopeGlobal, state.rateLimit); err != nil {
+		writeError(r.Context(), s.log, w, err)
+		return
+	}
 	if _, ok := allowedHTTPMethods[r.Method]; !ok {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		w.Header().Set(headerAllow, allowMethods)
+		writeError(r.Context(), s.log, w, kerrors.WithKind(nil, ErrMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	if rule, target, ok := matchRules(state.rules.Redirects, r.URL.Path); ok {
+		http.Redirect(w, r, withQuery(target, r.URL), rule.Status)
 		return
 	}
-	s.mux.ServeHTTP(w, r)
+	if _, target, ok := matchRules(state.rules.Rewrites, r.URL.Path); ok {
+		r2, err := rewriteRequest(r, target)
+		if err != nil {
+			writeError(r.Context(), s.log, w, err)
+			return
+		}
+		s.log.Debug(r.Context(), "Rewrite request path",
+			klog.AString("http.rewritepath", r2.URL.EscapedPath()),
+		)
+		r = r2
+	}
+	h, pattern := state.mux.Handler(r)
+	w2.route = pattern
+	h.ServeHTTP(w, r)
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	state := s.state.Load()
 	lreqid := s.lreqID()
-	realip := getRealIP(r, s.config.Proxies)
+	realip := getRealIP(r, state.proxies)
 	ctx = klog.CtxWithAttrs(ctx,
 		klog.AString("http.host", r.Host),
 		klog.AString("http.method", r.Method),
-		klog.AString("http.reqpath", r.URL.EscapedPath()),
+		klog.AString("http.reqpath", redactedReqPath(r.URL)),
 		klog.AString("http.remote", r.RemoteAddr),
 		klog.AString("http.realip", realip),
 		klog.AString("http.lreqid", lreqid),
 	)
+	if cert := getVerifiedClientCert(r); cert != nil {
+		ctx = klog.CtxWithAttrs(ctx,
+			klog.AString("tls.client.subject", cert.Subject.String()),
+			klog.AString("tls.client.serial", cert.SerialNumber.String()),
+		)
+	}
+	ctx = context.WithValue(ctx, ctxKeyLReqID{}, lreqid)
+	ctx = context.WithValue(ctx, ctxKeyMetrics{}, s.metrics)
+	principal := &authPrincipal{}
+	ctx = context.WithValue(ctx, ctxKeyPrincipal{}, principal)
+	if ip, err := netip.ParseAddr(realip); err == nil {
+		ctx = context.WithValue(ctx, ctxKeyRealIP{}, ip)
+	}
 	r = r.WithContext(ctx)
 	w2 := &serverResponseWriter{
 		w:      w,
 		status: 0,
 	}
 	s.log.Info(ctx, "HTTP request")
+	s.metrics.inFlight.Add(1)
 	start := time.Now()
-	s.handleHTTP(w2, r)
+	s.handleHTTP(state, w2, r)
 	duration := time.Since(start)
+	s.metrics.inFlight.Add(-1)
+	status := w2.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	encoding := w2.Header().Get(headerContentEncoding)
+	s.metrics.observeRequest(w2.route, status, encoding, w2.written, duration)
+	if s.config.AccessLogWriter != nil && state.accessLog != nil {
+		s.writeAccessLog(ctx, state.accessLog, accessLogEntry{
+			time:      start,
+			remoteIP:  realip,
+			principal: principal.name,
+			lreqid:    lreqid,
+			method:    r.Method,
+			path:      redactedReqPath(r.URL),
+			proto:     r.Proto,
+			host:      r.Host,
+			status:    status,
+			bytes:     w2.written,
+			referer:   r.Referer(),
+			userAgent: r.UserAgent(),
+			route:     w2.route,
+			encoding:  encoding,
+			latency:   duration,
+		})
+	}
+	if principal.name != "" {
+		ctx = klog.CtxWithAttrs(ctx, klog.AString("http.principal", principal.name))
+	}
 	s.log.Info(ctx, "HTTP response",
 		klog.AInt("http.status", w2.status),
 		klog.AInt64("http.latency_us", duration.Microseconds()),
 	)
 }
 
-func (s *Server) Serve(ctx context.Context, port int, opts Opts) {
+func (s *Server) Serve(ctx context.Context, opts Opts) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	srv := http.Server{
-		Addr:              ":" + strconv.Itoa(port),
-		Handler:           s,
+
+	if len(opts.Listeners) == 0 {
+		s.log.Err(context.Background(), kerrors.WithMsg(nil, "No listeners configured"))
+		return
+	}
+
+	var certs *certReloader
+	if opts.TLS.Enabled() {
+		var err error
+		certs, err = newCertReloader(s.log, opts.TLS.CertFile, opts.TLS.KeyFile)
+		if err != nil {
+			s.log.Err(context.Background(), kerrors.WithMsg(err, "Failed to init tls"))
+			return
+		}
+	}
+	clientCAs, err := loadClientCAs(opts.TLS.ClientCAFiles)
+	if err != nil {
+		s.log.Err(context.Background(), kerrors.WithMsg(err, "Failed to init tls"))
+		return
+	}
+	allListeners := slices.Concat(opts.Listeners, opts.AdminListeners)
+	for _, i := range allListeners {
+		if i.TLS && certs == nil {
+			s.log.Err(context.Background(), kerrors.WithMsg(nil, fmt.Sprintf("TLS listener %s %s requires a tls cert and key", i.Network, i.Addr)))
+			return
+		}
+	}
+	// routes are checked again on reload once the server is serving
+	clientCerts := &clientCertSupport{
+		clientCA: clientCAs != nil,
+		tlsListener: slices.ContainsFunc(opts.Listeners, func(l Listener) bool {
+			return l.TLS
+		}),
+	}
+	s.clientCerts.Store(clientCerts)
+	if err := clientCerts.checkRoutes(s.state.Load().routes); err != nil {
+		s.log.Err(context.Background(), kerrors.WithMsg(err, "Invalid routes"))
+		return
+	}
+
+	// admin listeners are opened together so that all listeners are closed if
+	// any fail to open
+	listeners, err := openListeners(allListeners)
+	if err != nil {
+		s.log.Err(context.Background(), kerrors.WithMsg(err, "Failed to open listeners"))
+		return
+	}
+	adminListeners := listeners[len(opts.Listeners):]
+	listeners = listeners[:len(opts.Listeners)]
+
+	srv := &http.Server{
+		Handler:           hstsHandler(opts.TLS.HSTS, s),
 		ReadTimeout:       opts.ReadTimeout,
 		ReadHeaderTimeout: opts.ReadHeaderTimeout,
 		WriteTimeout:      opts.WriteTimeout,
 		IdleTimeout:       opts.IdleTimeout,
 		MaxHeaderBytes:    opts.MaxHeaderBytes,
+		ConnState:         s.metrics.connState,
+	}
+	if certs != nil {
+		srv.TLSConfig = newTLSConfig(certs, opts.TLS, clientCAs)
+	}
+	adminSrv := &http.Server{
+		Handler:           s.adminHandler(),
+		ReadTimeout:       opts.ReadTimeout,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+	}
+	if certs != nil {
+		adminSrv.TLSConfig = newTLSConfig(certs, opts.TLS, nil)
+	}
+	servers := []*http.Server{srv, adminSrv}
+
+	var wg sync.WaitGroup
+
+	serveListener := func(srv *http.Server, i boundListener, msg string) {
+		l := i.l
+		useTLS := i.cfg.TLS
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			var err error
+			if useTLS {
+				// cert and key are provided by the tls config GetCertificate
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.log.Err(context.Background(), kerrors.WithMsg(err, "Shutting down server"),
+					klog.AString("http.server.addr", l.Addr().String()),
+				)
+			}
+		}()
+		s.log.Info(context.Background(), msg,
+			klog.AString("http.server.network", i.cfg.Network),
+			klog.AString("http.server.addr", l.Addr().String()),
+			klog.ABool("http.server.tls", useTLS),
+		)
 	}
-	go func() {
-		defer cancel()
-		if err := srv.ListenAndServe(); err != nil {
-			s.log.Err(context.Background(), kerrors.WithMsg(err, "Shutting down server"))
+
+	httpsPort := 0
+	for _, i := range listeners {
+		if addr, ok := i.l.Addr().(*net.TCPAddr); ok && i.cfg.TLS && httpsPort == 0 {
+			httpsPort = addr.Port
 		}
-	}()
-	s.log.Info(context.Background(), "HTTP server listening",
-		klog.AString("http.server.addr", srv.Addr),
-	)
+		serveListener(srv, i, "HTTP server listening")
+	}
+	for _, i := range adminListeners {
+		serveListener(adminSrv, i, "HTTP admin server listening")
+	}
+
+	if certs != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			certs.watch(ctx, opts.TLS.ReloadInterval)
+		}()
+
+		if opts.TLS.RedirectPort != 0 {
+			redirectSrv := &http.Server{
+				Addr:              ":" + strconv.Itoa(opts.TLS.RedirectPort),
+				Handler:           &httpsRedirect{port: httpsPort},
+				ReadTimeout:       opts.ReadTimeout,
+				ReadHeaderTimeout: opts.ReadHeaderTimeout,
+				WriteTimeout:      opts.WriteTimeout,
+				IdleTimeout:       opts.IdleTimeout,
+				MaxHeaderBytes:    opts.MaxHeaderBytes,
+			}
+			servers = append(servers, redirectSrv)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer cancel()
+				if err := redirectSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					s.log.Err(context.Background(), kerrors.WithMsg(err, "Shutting down https redirect server"))
+				}
+			}()
+			s.log.Info(context.Background(), "HTTPS redirect server listening",
+				klog.AString("http.server.addr", redirectSrv.Addr),
+			)
+		}
+	}
+
 	<-ctx.Done()
+	// readiness fails for the remainder of the graceful shutdown
+	s.draining.Store(true)
 	shutdownCtx, shutdownCancel := context.WithTimeout(klog.ExtendCtx(context.Background(), ctx), opts.GracefulShutdown)
 	defer shutdownCancel()
-	if err := srv.Shutdown(shutdownCtx); err != nil {
-		s.log.Err(context.Background(), kerrors.WithMsg(err, "Failed to shut down server"))
+	// shutdown closes all listeners of each server
+	for _, i := range servers {
+		if err := i.Shutdown(shutdownCtx); err != nil {
+			s.log.Err(context.Background(), kerrors.WithMsg(err, "Failed to shut down server"))
+		}
 	}
+	wg.Wait()
 }
@@ -4,21 +4,40 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
+	"fmt"
 	"io"
 	"io/fs"
+	"math/big"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/blake2b"
 	"xorkevin.dev/fsserve/util/kjson"
+	"xorkevin.dev/kerrors"
 	"xorkevin.dev/kfs"
 	"xorkevin.dev/klog"
 )
@@ -397,13 +416,13 @@ func TestServer(t *testing.T) {
 			http.MethodPatch,
 			http.MethodDelete,
 			http.MethodConnect,
-			http.MethodOptions,
 			http.MethodTrace,
 		} {
 			req := httptest.NewRequest(i, "/", nil)
 			rec := httptest.NewRecorder()
 			server.ServeHTTP(rec, req)
 			assert.Equal(http.StatusMethodNotAllowed, rec.Code)
+			assert.Equal("GET, HEAD, OPTIONS", rec.Result().Header.Get(headerAllow))
 		}
 	})
 
@@ -418,9 +437,13 @@ func TestServer(t *testing.T) {
 		assert.Equal(http.StatusOK, rec.Code)
 		var listing resDirListing
 		assert.NoError(kjson.Unmarshal(rec.Body.Bytes(), &listing))
+		for n, i := range listing.Entries {
+			assert.False(i.ModTime.IsZero())
+			listing.Entries[n].ModTime = time.Time{}
+		}
 		assert.Equal(resDirListing{
 			Entries: []resDirEntry{
-				{Name: "file.txt"},
+				{Name: "file.txt", Size: 16, ContentType: "text/plain; charset=utf-8"},
 				{Name: "listingdir", Dir: true},
 			},
 		}, listing)
@@ -451,3 +474,3510 @@ func TestAddMimeTypes(t *testing.T) {
 		},
 	}))
 }
+
+func TestReloadMimeTypes(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "data.fsservereload"), []byte("data"), 0o644))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	routes := []Route{
+		{
+			Prefix:       "/",
+			Path:         "data.fsservereload",
+			DisableXAttr: true,
+		},
+	}
+	globals := Globals{
+		MimeTypes: []MimeType{
+			{Ext: ".fsservereload", ContentType: "application/x-fsserve-reload"},
+		},
+	}
+
+	// a failed reload does not register mime types
+	assert.Error(server.Reload([]Route{
+		{Prefix: "/", Path: "data.fsservereload"},
+		{Prefix: "/bogus/", Dir: true, Path: ".", Include: `(`},
+	}, Rules{}, nil, globals))
+	assert.Equal("", mime.TypeByExtension(".fsservereload"))
+
+	assert.Error(server.Reload(routes, Rules{}, nil, Globals{
+		MimeTypes: []MimeType{
+			{Ext: "fsservereload", ContentType: "application/x-fsserve-reload"},
+		},
+	}))
+	assert.Equal("", mime.TypeByExtension(".fsservereload"))
+
+	assert.NoError(server.Reload(routes, Rules{}, nil, globals))
+	assert.Equal("application/x-fsserve-reload", mime.TypeByExtension(".fsservereload"))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("application/x-fsserve-reload", rec.Result().Header.Get(headerContentType))
+}
+
+func writeTestCert(t *testing.T, certFile, keyFile string, cn string) {
+	t.Helper()
+
+	assert := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	assert.NoError(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+}
+
+func TestCertReloader(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	certFile := filepath.Join(rootDir, "cert.pem")
+	keyFile := filepath.Join(rootDir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first.example.com")
+
+	certs, err := newCertReloader(klog.NewLevelLogger(klog.Discard{}), certFile, keyFile)
+	assert.NoError(err)
+
+	cert, err := certs.getCertificate(nil)
+	assert.NoError(err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(err)
+	assert.Equal("first.example.com", leaf.Subject.CommonName)
+
+	// unchanged files do not reload
+	certs.reloadIfChanged(context.Background())
+	cert2, err := certs.getCertificate(nil)
+	assert.NoError(err)
+	assert.Same(cert, cert2)
+
+	writeTestCert(t, certFile, keyFile, "second.example.com")
+	later := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(certFile, later, later))
+	assert.NoError(os.Chtimes(keyFile, later, later))
+	certs.reloadIfChanged(context.Background())
+
+	cert, err = certs.getCertificate(nil)
+	assert.NoError(err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(err)
+	assert.Equal("second.example.com", leaf.Subject.CommonName)
+
+	// invalid files retain the previous cert
+	assert.NoError(os.WriteFile(keyFile, []byte("bogus"), 0o600))
+	later = later.Add(time.Minute)
+	assert.NoError(os.Chtimes(keyFile, later, later))
+	certs.reloadIfChanged(context.Background())
+	cert2, err = certs.getCertificate(nil)
+	assert.NoError(err)
+	assert.Same(cert, cert2)
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name     string
+		Host     string
+		Path     string
+		Port     int
+		Location string
+	}{
+		{
+			Name:     "default port",
+			Host:     "example.com:80",
+			Path:     "/some/path?a=b",
+			Port:     443,
+			Location: "https://example.com/some/path?a=b",
+		},
+		{
+			Name:     "custom port",
+			Host:     "example.com",
+			Path:     "/",
+			Port:     8443,
+			Location: "https://example.com:8443/",
+		},
+		{
+			Name:     "ipv6",
+			Host:     "[::1]:8080",
+			Path:     "/",
+			Port:     443,
+			Location: "https://[::1]/",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			req.Host = tc.Host
+			rec := httptest.NewRecorder()
+			(&httpsRedirect{port: tc.Port}).ServeHTTP(rec, req)
+			assert.Equal(http.StatusPermanentRedirect, rec.Code)
+			assert.Equal(tc.Location, rec.Result().Header.Get("Location"))
+		})
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	sockPath := filepath.Join(t.TempDir(), "fsserve.sock")
+	// stale sockets are replaced
+	stale, err := net.Listen("unix", sockPath)
+	assert.NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.NoError(stale.Close())
+
+	listeners, err := openListeners([]Listener{
+		{Network: "tcp", Addr: "127.0.0.1:0"},
+		{Network: "unix", Addr: sockPath, Mode: "660"},
+	})
+	assert.NoError(err)
+	assert.Len(listeners, 2)
+	defer func() {
+		assert.NoError(closeBoundListeners(listeners))
+	}()
+
+	assert.IsType(&net.TCPAddr{}, listeners[0].l.Addr())
+	stat, err := os.Stat(sockPath)
+	assert.NoError(err)
+	assert.Equal(fs.ModeSocket, stat.Mode().Type())
+	assert.Equal(fs.FileMode(0o660), stat.Mode().Perm())
+
+	_, err = openListeners([]Listener{
+		{Network: "bogus", Addr: "127.0.0.1:0"},
+	})
+	assert.Error(err)
+}
+
+func TestServerReload(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "a.txt"), []byte(`file a`), 0o644))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "b.txt"), []byte(`file b`), 0o644))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{Prefix: "/a", Path: "a.txt"},
+		{Prefix: "/c", Path: "a.txt"},
+	}))
+
+	get := func(p string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(http.StatusOK, get("/a").Code)
+	assert.Equal(http.StatusNotFound, get("/b").Code)
+
+	// invalid routes retain the previous routes
+	assert.Error(server.Reload([]Route{
+		{Prefix: "/b", Path: "b.txt"},
+		{Prefix: "/bogus/", Dir: true, Path: ".", Include: `(`},
+	}, Rules{}, nil, Globals{}))
+	assert.Equal(http.StatusOK, get("/a").Code)
+	assert.Equal(http.StatusNotFound, get("/b").Code)
+	// duplicate prefixes are rejected instead of panicking
+	assert.Error(server.Reload([]Route{
+		{Prefix: "/b", Path: "b.txt"},
+		{Prefix: "/b", Path: "b.txt"},
+	}, Rules{}, nil, Globals{}))
+	assert.Equal(http.StatusOK, get("/a").Code)
+
+	prevRoutes := server.state.Load().routes
+	nextRoutes := []Route{
+		{Prefix: "/b", Path: "b.txt"},
+		{Prefix: "/c", Path: "b.txt"},
+	}
+	assert.NoError(server.Reload(nextRoutes, Rules{}, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Globals{}))
+	assert.Equal(http.StatusNotFound, get("/a").Code)
+	rec := get("/b")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(`file b`, rec.Body.String())
+	assert.Equal(`file b`, get("/c").Body.String())
+
+	added, removed, changed := diffRoutes(prevRoutes, nextRoutes)
+	assert.Equal([]string{"/b"}, added)
+	assert.Equal([]string{"/a"}, removed)
+	assert.Equal([]string{"/c"}, changed)
+}
+
+func TestDynamicCompression(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	content := strings.Repeat("this is a compressible js file\n", 64)
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "app.js"), []byte(content), 0o644))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "small.js"), []byte(`small`), 0o644))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "image.png"), []byte(content), 0o644))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+		Instance: "testinstance",
+		CompressCache: CompressCacheConfig{
+			Dir:     t.TempDir(),
+			MaxSize: 1 << 20,
+		},
+	})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:             "/",
+			Dir:                true,
+			Path:               ".",
+			CacheControl:       "no-cache",
+			StrongETagOverride: true,
+			Compress: Compression{
+				Codes:   []string{"zstd", "gzip"},
+				MinSize: 64,
+			},
+		},
+	}))
+
+	assert.Error(server.Reload([]Route{
+		{
+			Prefix:   "/",
+			Path:     "app.js",
+			Compress: Compression{Codes: []string{"bogus"}},
+		},
+	}, Rules{}, nil, Globals{}))
+
+	get := func(p string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/app.js", map[string]string{headerAcceptEncoding: "gzip"})
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("gzip", rec.Result().Header.Get(headerContentEncoding))
+	compressed := rec.Body.Bytes()
+	assert.Less(len(compressed), len(content))
+	gr, err := gzip.NewReader(bytes.NewReader(compressed))
+	assert.NoError(err)
+	b, err := io.ReadAll(gr)
+	assert.NoError(err)
+	assert.Equal(content, string(b))
+	gzipETag := rec.Result().Header.Get(headerETag)
+	assert.True(strings.HasSuffix(gzipETag, `.gzip"`))
+
+	rec = get("/app.js", nil)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("", rec.Result().Header.Get(headerContentEncoding))
+	assert.Equal(content, rec.Body.String())
+	assert.NotEqual(gzipETag, rec.Result().Header.Get(headerETag))
+
+	rec = get("/app.js", map[string]string{headerAcceptEncoding: "gzip, zstd"})
+	assert.Equal("zstd", rec.Result().Header.Get(headerContentEncoding))
+	assert.NotEqual(gzipETag, rec.Result().Header.Get(headerETag))
+
+	// range requests are served from the cached compressed body
+	rec = get("/app.js", map[string]string{
+		headerAcceptEncoding: "gzip",
+		"Range":              "bytes=0-9",
+		"If-Range":           gzipETag,
+	})
+	assert.Equal(http.StatusPartialContent, rec.Code)
+	assert.Equal(compressed[:10], rec.Body.Bytes())
+
+	rec = get("/app.js", map[string]string{
+		headerAcceptEncoding: "gzip",
+		headerIfNoneMatch:    gzipETag,
+	})
+	assert.Equal(http.StatusNotModified, rec.Code)
+
+	// small files and disallowed content types are not compressed
+	rec = get("/small.js", map[string]string{headerAcceptEncoding: "gzip"})
+	assert.Equal("", rec.Result().Header.Get(headerContentEncoding))
+	rec = get("/image.png", map[string]string{headerAcceptEncoding: "gzip"})
+	assert.Equal("", rec.Result().Header.Get(headerContentEncoding))
+
+	assert.Error(server.Reload([]Route{
+		{
+			Prefix:   "/",
+			Path:     "app.js",
+			Compress: Compression{Codes: []string{"gzip"}, MaxSize: -1},
+		},
+	}, Rules{}, nil, Globals{}))
+
+	// files larger than the route max size or the cache max size are not
+	// compressed
+	for _, i := range []struct {
+		cacheMaxSize int64
+		maxSize      int64
+	}{
+		{cacheMaxSize: 1 << 20, maxSize: 256},
+		{cacheMaxSize: 256, maxSize: 0},
+	} {
+		server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+			Instance: "testinstance",
+			CompressCache: CompressCacheConfig{
+				MaxSize: i.cacheMaxSize,
+			},
+		})
+		assert.NoError(server.Mount([]Route{
+			{
+				Prefix: "/",
+				Dir:    true,
+				Path:   ".",
+				Compress: Compression{
+					Codes:   []string{"gzip"},
+					MaxSize: i.maxSize,
+				},
+			},
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+		req.Header.Set(headerAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("", rec.Result().Header.Get(headerContentEncoding))
+		assert.Equal(content, rec.Body.String())
+	}
+}
+
+func TestCompressCache(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	cache := newCompressCache(klog.NewLevelLogger(klog.Discard{}), CompressCacheConfig{
+		MaxSize: 8,
+	})
+
+	readBody := func(body *compressedBody) string {
+		b, err := io.ReadAll(body.r)
+		assert.NoError(err)
+		assert.NoError(body.close())
+		return string(b)
+	}
+
+	var computeCount atomic.Int32
+	release := make(chan struct{})
+	compute := func() ([]byte, error) {
+		computeCount.Add(1)
+		<-release
+		return []byte("abcd"), nil
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := cache.get(context.Background(), "a", compute)
+			assert.NoError(err)
+			assert.Equal("abcd", readBody(body))
+		}()
+	}
+	for {
+		cache.mu.Lock()
+		_, ok := cache.flights["a"]
+		cache.mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	assert.Equal(int32(1), computeCount.Load())
+
+	body, err := cache.get(context.Background(), "a", compute)
+	assert.NoError(err)
+	assert.Equal("abcd", readBody(body))
+	assert.Equal(int32(1), computeCount.Load())
+
+	for _, i := range []string{"b", "c"} {
+		body, err := cache.get(context.Background(), i, func() ([]byte, error) {
+			return []byte("efgh"), nil
+		})
+		assert.NoError(err)
+		assert.Equal("efgh", readBody(body))
+	}
+	// least recently used entry is evicted to bound the cache size
+	assert.LessOrEqual(cache.size, int64(8))
+	assert.NotContains(cache.entries, "a")
+	assert.Contains(cache.entries, "b")
+	assert.Contains(cache.entries, "c")
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Name    string
+		Headers []string
+		Weights map[string]int
+	}{
+		{
+			Name:    "missing header only accepts identity",
+			Headers: nil,
+			Weights: map[string]int{"gzip": 0, "identity": 1000},
+		},
+		{
+			Name:    "empty header only accepts identity",
+			Headers: []string{""},
+			Weights: map[string]int{"gzip": 0, "identity": 1},
+		},
+		{
+			Name:    "unweighted codings",
+			Headers: []string{"gzip, br"},
+			Weights: map[string]int{"gzip": 1000, "br": 1000, "zstd": 0, "identity": 1},
+		},
+		{
+			Name:    "weights",
+			Headers: []string{"gzip;q=0.5, br; q=1.0 ,zstd;Q=0.125"},
+			Weights: map[string]int{"gzip": 500, "br": 1000, "zstd": 125},
+		},
+		{
+			Name:    "zero weight is not acceptable",
+			Headers: []string{"gzip;q=0, br"},
+			Weights: map[string]int{"gzip": 0, "br": 1000},
+		},
+		{
+			Name:    "wildcard",
+			Headers: []string{"gzip;q=0.2, *;q=0.5"},
+			Weights: map[string]int{"gzip": 200, "br": 500, "identity": 1},
+		},
+		{
+			Name:    "wildcard excludes identity",
+			Headers: []string{"gzip, *;q=0"},
+			Weights: map[string]int{"gzip": 1000, "br": 0, "identity": 0},
+		},
+		{
+			Name:    "identity excluded",
+			Headers: []string{"gzip, identity;q=0"},
+			Weights: map[string]int{"gzip": 1000, "identity": 0},
+		},
+		{
+			Name:    "explicit identity overrides wildcard",
+			Headers: []string{"*;q=0, identity;q=0.5"},
+			Weights: map[string]int{"gzip": 0, "identity": 500},
+		},
+		{
+			Name:    "case insensitive and aliases",
+			Headers: []string{"X-GZIP;q=0.3"},
+			Weights: map[string]int{"gzip": 300},
+		},
+		{
+			Name:    "multiple headers",
+			Headers: []string{"gzip;q=0.3", "br"},
+			Weights: map[string]int{"gzip": 300, "br": 1000},
+		},
+		{
+			Name:    "invalid weights are ignored",
+			Headers: []string{"gzip;q=2, br;q=0.1234, zstd;q=abc, deflate;q=0.7"},
+			Weights: map[string]int{"gzip": 0, "br": 0, "zstd": 0, "deflate": 700},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			headers := http.Header{}
+			for _, i := range tc.Headers {
+				headers.Add(headerAcceptEncoding, i)
+			}
+			accept := parseAcceptEncoding(headers)
+			for k, v := range tc.Weights {
+				assert.Equal(v, accept.weight(k), k)
+			}
+		})
+	}
+}
+
+func TestEncodingNegotiation(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	content := strings.Repeat("this is a compressible js file\n", 64)
+	for _, i := range []string{"app.js", "app.js.gz", "app.js.br", "only.js.gz"} {
+		assert.NoError(os.WriteFile(filepath.Join(rootDir, i), []byte(content), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix: "/",
+			Dir:    true,
+			Path:   ".",
+			Encodings: []Encoding{
+				{Code: "br", Ext: ".br"},
+				{Code: "gzip", Ext: ".gz"},
+			},
+			Compress: Compression{
+				Codes: []string{"zstd"},
+			},
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name     string
+		Path     string
+		Accept   string
+		Status   int
+		Encoding string
+	}{
+		{
+			Name:     "route order breaks ties",
+			Path:     "/app.js",
+			Accept:   "gzip, br",
+			Status:   http.StatusOK,
+			Encoding: "br",
+		},
+		{
+			Name:     "client weight takes precedence over route order",
+			Path:     "/app.js",
+			Accept:   "gzip, br;q=0.5",
+			Status:   http.StatusOK,
+			Encoding: "gzip",
+		},
+		{
+			Name:     "zero weight is not used",
+			Path:     "/app.js",
+			Accept:   "gzip;q=0, br;q=0",
+			Status:   http.StatusOK,
+			Encoding: "",
+		},
+		{
+			Name:     "precompressed is preferred over dynamic on ties",
+			Path:     "/app.js",
+			Accept:   "zstd, gzip",
+			Status:   http.StatusOK,
+			Encoding: "gzip",
+		},
+		{
+			Name:     "dynamic is used when preferred",
+			Path:     "/app.js",
+			Accept:   "zstd, gzip;q=0.9",
+			Status:   http.StatusOK,
+			Encoding: "zstd",
+		},
+		{
+			Name:     "wildcard",
+			Path:     "/app.js",
+			Accept:   "*",
+			Status:   http.StatusOK,
+			Encoding: "br",
+		},
+		{
+			Name:     "identity preferred over coding",
+			Path:     "/app.js",
+			Accept:   "gzip;q=0.5, identity",
+			Status:   http.StatusOK,
+			Encoding: "",
+		},
+		{
+			Name:     "only precompressed variant exists",
+			Path:     "/only.js",
+			Accept:   "gzip",
+			Status:   http.StatusOK,
+			Encoding: "gzip",
+		},
+		{
+			Name:   "nothing acceptable",
+			Path:   "/app.js",
+			Accept: "deflate, identity;q=0",
+			Status: http.StatusNotAcceptable,
+		},
+		{
+			Name:   "wildcard excludes identity",
+			Path:   "/app.js",
+			Accept: "deflate, *;q=0",
+			Status: http.StatusNotAcceptable,
+		},
+		{
+			Name:   "missing file",
+			Path:   "/bogus.js",
+			Accept: "gzip",
+			Status: http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			req.Header.Set(headerAcceptEncoding, tc.Accept)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+			if tc.Status == http.StatusOK {
+				assert.Equal(tc.Encoding, rec.Result().Header.Get(headerContentEncoding))
+			}
+		})
+	}
+}
+
+func TestVariantNegotiation(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	for _, i := range []string{"photo.jpg", "photo.jpg.avif", "photo.jpg.webp", "photo.jpg.webp.gz", "plain.jpg", "doc.txt"} {
+		assert.NoError(os.WriteFile(filepath.Join(rootDir, i), []byte(i), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix: "/",
+			Dir:    true,
+			Path:   ".",
+			Encodings: []Encoding{
+				{Code: "gzip", Ext: ".gz"},
+			},
+			Variants: []Variant{
+				{ContentType: "image/avif", Match: `\.jpg$`, Ext: ".avif"},
+				{ContentType: "image/webp", Match: `\.jpg$`, Ext: ".webp"},
+			},
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name           string
+		Path           string
+		Accept         string
+		AcceptEncoding string
+		Status         int
+		Body           string
+		ContentType    string
+	}{
+		{
+			Name:        "route order breaks ties",
+			Path:        "/photo.jpg",
+			Accept:      "image/avif,image/webp,image/*;q=0.8",
+			Status:      http.StatusOK,
+			Body:        "photo.jpg.avif",
+			ContentType: "image/avif",
+		},
+		{
+			Name:        "client weight takes precedence over route order",
+			Path:        "/photo.jpg",
+			Accept:      "image/avif;q=0.5,image/webp,*/*;q=0.1",
+			Status:      http.StatusOK,
+			Body:        "photo.jpg.webp",
+			ContentType: "image/webp",
+		},
+		{
+			Name:        "original preferred",
+			Path:        "/photo.jpg",
+			Accept:      "image/jpeg,image/*;q=0.5",
+			Status:      http.StatusOK,
+			Body:        "photo.jpg",
+			ContentType: "image/jpeg",
+		},
+		{
+			Name:        "variants are preferred on ties",
+			Path:        "/photo.jpg",
+			Accept:      "*/*",
+			Status:      http.StatusOK,
+			Body:        "photo.jpg.avif",
+			ContentType: "image/avif",
+		},
+		{
+			Name:        "no accept header",
+			Path:        "/photo.jpg",
+			Status:      http.StatusOK,
+			Body:        "photo.jpg",
+			ContentType: "image/jpeg",
+		},
+		{
+			Name:        "missing variants",
+			Path:        "/plain.jpg",
+			Accept:      "image/avif,image/webp",
+			Status:      http.StatusOK,
+			Body:        "plain.jpg",
+			ContentType: "image/jpeg",
+		},
+		{
+			Name:           "variant with encoding",
+			Path:           "/photo.jpg",
+			Accept:         "image/webp",
+			AcceptEncoding: "gzip",
+			Status:         http.StatusOK,
+			Body:           "photo.jpg.webp.gz",
+			ContentType:    "image/webp",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			if tc.Accept != "" {
+				req.Header.Set(headerAccept, tc.Accept)
+			}
+			if tc.AcceptEncoding != "" {
+				req.Header.Set(headerAcceptEncoding, tc.AcceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+			assert.Equal(tc.Body, rec.Body.String())
+			assert.Equal(tc.ContentType, rec.Result().Header.Get(headerContentType))
+			assert.Contains(rec.Result().Header.Values(headerVary), headerAccept)
+		})
+	}
+
+	t.Run("does not vary files without variants", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/doc.txt", nil)
+		req.Header.Set(headerAccept, "image/avif,image/webp")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("doc.txt", rec.Body.String())
+		assert.NotContains(rec.Result().Header.Values(headerVary), headerAccept)
+	})
+}
+
+func TestLanguageNegotiation(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	for _, i := range []string{"index.html", "index.en.html", "index.de.html", "index.fr.html.gz", "about.html"} {
+		assert.NoError(os.WriteFile(filepath.Join(rootDir, i), []byte(i), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix: "/",
+			Dir:    true,
+			Path:   ".",
+			Encodings: []Encoding{
+				{Code: "gzip", Ext: ".gz"},
+			},
+			Localize: Localization{
+				Languages: []string{"en", "fr", "de"},
+				Default:   "en",
+				Query:     "lang",
+				Cookie:    "lang",
+			},
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name           string
+		Path           string
+		AcceptLanguage string
+		AcceptEncoding string
+		Cookie         string
+		Body           string
+		Language       string
+	}{
+		{
+			Name:           "client weight",
+			Path:           "/index.html",
+			AcceptLanguage: "de;q=0.9, en;q=0.5",
+			Body:           "index.de.html",
+			Language:       "de",
+		},
+		{
+			Name:           "region falls back to language",
+			Path:           "/index.html",
+			AcceptLanguage: "de-CH",
+			Body:           "index.de.html",
+			Language:       "de",
+		},
+		{
+			Name:     "default without header",
+			Path:     "/index.html",
+			Body:     "index.en.html",
+			Language: "en",
+		},
+		{
+			Name:           "default when nothing acceptable",
+			Path:           "/index.html",
+			AcceptLanguage: "ja",
+			Body:           "index.en.html",
+			Language:       "en",
+		},
+		{
+			Name:           "composes with encodings",
+			Path:           "/index.html",
+			AcceptLanguage: "fr",
+			AcceptEncoding: "gzip",
+			Body:           "index.fr.html.gz",
+			Language:       "fr",
+		},
+		{
+			Name:           "missing localized file is skipped",
+			Path:           "/index.html",
+			AcceptLanguage: "fr, de;q=0.5",
+			Body:           "index.de.html",
+			Language:       "de",
+		},
+		{
+			Name:           "query override",
+			Path:           "/index.html?lang=de",
+			AcceptLanguage: "en",
+			Body:           "index.de.html",
+			Language:       "de",
+		},
+		{
+			Name:           "cookie override",
+			Path:           "/index.html",
+			AcceptLanguage: "en",
+			Cookie:         "DE",
+			Body:           "index.de.html",
+			Language:       "de",
+		},
+		{
+			Name:           "unlocalized file",
+			Path:           "/about.html",
+			AcceptLanguage: "de",
+			Body:           "about.html",
+			Language:       "",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			if tc.AcceptLanguage != "" {
+				req.Header.Set(headerAcceptLanguage, tc.AcceptLanguage)
+			}
+			if tc.AcceptEncoding != "" {
+				req.Header.Set(headerAcceptEncoding, tc.AcceptEncoding)
+			}
+			if tc.Cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "lang", Value: tc.Cookie})
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(http.StatusOK, rec.Code)
+			assert.Equal(tc.Body, rec.Body.String())
+			assert.Equal(tc.Language, rec.Result().Header.Get(headerContentLanguage))
+			assert.Contains(rec.Result().Header.Values(headerVary), headerAcceptLanguage)
+		})
+	}
+}
+
+func TestDirListing(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	now := time.Now().Round(time.Second)
+	for n, i := range []struct {
+		name    string
+		content string
+	}{
+		{name: "b.txt", content: "a"},
+		{name: "a.txt", content: "aaa"},
+		{name: "c.txt", content: "aa"},
+	} {
+		p := filepath.Join(rootDir, "files", i.name)
+		assert.NoError(os.MkdirAll(filepath.Dir(p), 0o755))
+		assert.NoError(os.WriteFile(p, []byte(i.content), 0o644))
+		mtime := now.Add(time.Duration(n) * time.Minute)
+		assert.NoError(os.Chtimes(p, mtime, mtime))
+	}
+	tmplFile := filepath.Join(t.TempDir(), "dirlist.html")
+	assert.NoError(os.WriteFile(tmplFile, []byte(`{{range .Entries}}{{.Name}}={{.URL}};{{end}}`), 0o644))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:  "/files/",
+			Dir:     true,
+			Path:    "files",
+			DirList: true,
+		},
+		{
+			Prefix:          "/custom/",
+			Dir:             true,
+			Path:            "files",
+			DirList:         true,
+			DirListTemplate: tmplFile,
+		},
+	}))
+
+	listNames := func(t *testing.T, target string) []string {
+		t.Helper()
+		assert := require.New(t)
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("application/json", rec.Result().Header.Get(headerContentType))
+		var listing resDirListing
+		assert.NoError(kjson.Unmarshal(rec.Body.Bytes(), &listing))
+		var names []string
+		for _, i := range listing.Entries {
+			names = append(names, i.Name)
+		}
+		return names
+	}
+
+	t.Run("sorts entries", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		assert.Equal([]string{"a.txt", "b.txt", "c.txt"}, listNames(t, "/files/?dir=t"))
+		assert.Equal([]string{"c.txt", "b.txt", "a.txt"}, listNames(t, "/files/?dir=t&order=desc"))
+		assert.Equal([]string{"b.txt", "c.txt", "a.txt"}, listNames(t, "/files/?dir=t&sort=size"))
+		assert.Equal([]string{"c.txt", "a.txt", "b.txt"}, listNames(t, "/files/?dir=t&sort=time&order=desc"))
+
+		req := httptest.NewRequest(http.MethodGet, "/files/?dir=t&sort=bogus", nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("renders html", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/files/?dir=t", nil)
+		req.Header.Set(headerAccept, "text/html,application/xhtml+xml,*/*;q=0.8")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("text/html; charset=utf-8", rec.Result().Header.Get(headerContentType))
+		assert.Contains(rec.Body.String(), `<a href="/files/a.txt">a.txt</a>`)
+		assert.Contains(rec.Result().Header.Values(headerVary), headerAccept)
+
+		req = httptest.NewRequest(http.MethodGet, "/custom/?dir=t", nil)
+		req.Header.Set(headerAccept, "text/html")
+		rec = httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal("a.txt=/custom/a.txt;b.txt=/custom/b.txt;c.txt=/custom/c.txt;", rec.Body.String())
+	})
+
+	t.Run("returns not modified", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/files/?dir=t", nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		etag := rec.Result().Header.Get(headerETag)
+		assert.True(strings.HasPrefix(etag, `W/"`))
+
+		req = httptest.NewRequest(http.MethodGet, "/files/?dir=t", nil)
+		req.Header.Set(headerIfNoneMatch, etag)
+		rec = httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusNotModified, rec.Code)
+		assert.Equal(etag, rec.Result().Header.Get(headerETag))
+
+		req = httptest.NewRequest(http.MethodGet, "/files/?dir=t&order=desc", nil)
+		req.Header.Set(headerIfNoneMatch, etag)
+		rec = httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+	})
+}
+
+func TestDirListingPagination(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	for _, i := range []string{
+		"a.txt",
+		"b.txt",
+		"c.log",
+		"sub/d.txt",
+		"sub/deep/e.txt",
+		"sub/deep/deeper/f.txt",
+		"skip/g.txt",
+	} {
+		p := filepath.Join(rootDir, "files", filepath.FromSlash(i))
+		assert.NoError(os.MkdirAll(filepath.Dir(p), 0o755))
+		assert.NoError(os.WriteFile(p, []byte(i), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:          "/files/",
+			Dir:             true,
+			Path:            "files",
+			Exclude:         `\.log$|^skip`,
+			DirList:         true,
+			DirListLimit:    4,
+			DirListMaxDepth: 3,
+		},
+	}))
+
+	list := func(t *testing.T, target string) ([]string, string) {
+		t.Helper()
+		assert := require.New(t)
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		var listing resDirListing
+		assert.NoError(kjson.Unmarshal(rec.Body.Bytes(), &listing))
+		var names []string
+		for _, i := range listing.Entries {
+			names = append(names, i.Name)
+		}
+		return names, listing.Next
+	}
+
+	t.Run("paginates with a cursor", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		names, next := list(t, "/files/?dir=t&limit=2")
+		assert.Equal([]string{"a.txt", "b.txt"}, names)
+		assert.NotEqual("", next)
+		names, next = list(t, "/files/?dir=t&limit=2&after="+next)
+		assert.Equal([]string{"sub"}, names)
+		assert.Equal("", next)
+	})
+
+	t.Run("fills details after paginating", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		route := Route{
+			Prefix:       "/files/",
+			Dir:          true,
+			Path:         "files",
+			DirList:      true,
+			DisableXAttr: true,
+		}
+		dir, err := fs.Sub(kfs.DirFS(rootDir), "files")
+		assert.NoError(err)
+		listing, err := readDirEntries(context.Background(), klog.NewLevelLogger(klog.Discard{}), dir, route, ".", "", 1, nil)
+		assert.NoError(err)
+		assert.NotEmpty(listing)
+		for _, i := range listing {
+			assert.Equal("", i.ContentType)
+		}
+		fillDirEntryDetails(context.Background(), klog.NewLevelLogger(klog.Discard{}), dir, route, ".", listing[:1])
+		assert.Equal("a.txt", listing[0].Name)
+		assert.Equal("text/plain; charset=utf-8", listing[0].ContentType)
+		assert.Equal("", listing[1].ContentType)
+
+		req := httptest.NewRequest(http.MethodGet, "/files/?dir=t&limit=1", nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		var res resDirListing
+		assert.NoError(kjson.Unmarshal(rec.Body.Bytes(), &res))
+		assert.Len(res.Entries, 1)
+		assert.Equal("text/plain; charset=utf-8", res.Entries[0].ContentType)
+	})
+
+	t.Run("recursively lists to max depth", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		var all []string
+		target := "/files/?dir=t&recursive=t"
+		for {
+			names, next := list(t, target)
+			assert.LessOrEqual(len(names), 4)
+			all = append(all, names...)
+			if next == "" {
+				break
+			}
+			target = "/files/?dir=t&recursive=t&after=" + next
+		}
+		assert.Equal([]string{
+			"a.txt",
+			"b.txt",
+			"sub",
+			"sub/d.txt",
+			"sub/deep",
+			"sub/deep/deeper",
+			"sub/deep/e.txt",
+		}, all)
+
+		names, _ := list(t, "/files/sub?dir=t&recursive=t&depth=2&limit=10")
+		assert.Equal([]string{"d.txt", "deep", "deep/deeper", "deep/e.txt"}, names)
+	})
+
+	t.Run("rejects invalid params", func(t *testing.T) {
+		t.Parallel()
+
+		for _, i := range []string{
+			"/files/?dir=t&limit=0",
+			"/files/?dir=t&after=bogus",
+			"/files/?dir=t&recursive=t&depth=4",
+		} {
+			assert := require.New(t)
+			req := httptest.NewRequest(http.MethodGet, i, nil)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(http.StatusBadRequest, rec.Code, i)
+		}
+	})
+}
+
+func TestHideEncoded(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	for _, i := range []string{"app.js", "app.js.gz", "app.js.br", "archive.tar.gz"} {
+		assert.NoError(os.WriteFile(filepath.Join(rootDir, i), []byte(i), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix: "/",
+			Dir:    true,
+			Path:   ".",
+			Encodings: []Encoding{
+				{Code: "br", Ext: ".br"},
+				{Code: "gzip", Ext: ".gz"},
+			},
+			DirList:     true,
+			HideEncoded: true,
+			DenyEncoded: true,
+		},
+	}))
+
+	t.Run("lists available encodings", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/?dir=t", nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		var listing resDirListing
+		assert.NoError(kjson.Unmarshal(rec.Body.Bytes(), &listing))
+		assert.Len(listing.Entries, 2)
+		assert.Equal("app.js", listing.Entries[0].Name)
+		assert.Equal([]string{"br", "gzip"}, listing.Entries[0].Encodings)
+		assert.Equal("archive.tar.gz", listing.Entries[1].Name)
+		assert.Nil(listing.Entries[1].Encodings)
+	})
+
+	t.Run("rejects direct requests for encoded files", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tc := range []struct {
+			Path   string
+			Status int
+		}{
+			{Path: "/app.js", Status: http.StatusOK},
+			{Path: "/app.js.gz", Status: http.StatusNotFound},
+			{Path: "/app.js.br", Status: http.StatusNotFound},
+			{Path: "/archive.tar.gz", Status: http.StatusOK},
+		} {
+			assert := require.New(t)
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code, tc.Path)
+		}
+	})
+}
+
+func TestDirRoutes(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	for _, i := range []string{
+		"app/index.html",
+		"app/app.js",
+		"app/docs/index.html",
+		"app/empty/.keep",
+	} {
+		p := filepath.Join(rootDir, filepath.FromSlash(i))
+		assert.NoError(os.MkdirAll(filepath.Dir(p), 0o755))
+		assert.NoError(os.WriteFile(p, []byte(i), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:               "/app/",
+			Dir:                  true,
+			Path:                 "app",
+			CacheControl:         "public, max-age=31536000",
+			Index:                []string{"index.htm", "index.html"},
+			TrailingSlash:        "add",
+			Fallback:             "index.html",
+			FallbackCacheControl: "no-cache",
+		},
+		{
+			Prefix:        "/strict/",
+			Dir:           true,
+			Path:          "app",
+			TrailingSlash: "strip",
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name         string
+		Path         string
+		Accept       string
+		FetchMode    string
+		Status       int
+		Body         string
+		Location     string
+		CacheControl string
+	}{
+		{
+			Name:         "serves root index",
+			Path:         "/app/",
+			Status:       http.StatusOK,
+			Body:         "app/index.html",
+			CacheControl: "public, max-age=31536000",
+		},
+		{
+			Name:         "serves subdir index",
+			Path:         "/app/docs/",
+			Status:       http.StatusOK,
+			Body:         "app/docs/index.html",
+			CacheControl: "public, max-age=31536000",
+		},
+		{
+			Name:     "redirects to add trailing slash",
+			Path:     "/app/docs?q=1",
+			Status:   http.StatusMovedPermanently,
+			Location: "docs/?q=1",
+		},
+		{
+			Name:   "missing index",
+			Path:   "/app/empty/",
+			Status: http.StatusNotFound,
+		},
+		{
+			Name:         "falls back for navigation",
+			Path:         "/app/some/client/route",
+			Accept:       "text/html,*/*;q=0.8",
+			Status:       http.StatusOK,
+			Body:         "app/index.html",
+			CacheControl: "no-cache",
+		},
+		{
+			Name:         "falls back for fetch navigation",
+			Path:         "/app/empty/",
+			Accept:       "*/*",
+			FetchMode:    "navigate",
+			Status:       http.StatusOK,
+			Body:         "app/index.html",
+			CacheControl: "no-cache",
+		},
+		{
+			Name:   "does not fall back for other requests",
+			Path:   "/app/missing.js",
+			Accept: "*/*",
+			Status: http.StatusNotFound,
+		},
+		{
+			Name:      "does not fall back for non navigation fetch",
+			Path:      "/app/missing.js",
+			Accept:    "text/html",
+			FetchMode: "cors",
+			Status:    http.StatusNotFound,
+		},
+		{
+			Name:     "redirects to strip trailing slash",
+			Path:     "/strict/app.js/",
+			Status:   http.StatusMovedPermanently,
+			Location: "../app.js",
+		},
+		{
+			Name:   "dir without index",
+			Path:   "/strict/docs/",
+			Status: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			if tc.Accept != "" {
+				req.Header.Set(headerAccept, tc.Accept)
+			}
+			if tc.FetchMode != "" {
+				req.Header.Set(headerSecFetchMode, tc.FetchMode)
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+			if tc.Status == http.StatusOK {
+				assert.Equal(tc.Body, rec.Body.String())
+				assert.Equal(tc.CacheControl, rec.Result().Header.Get(headerCacheControl))
+			}
+			if tc.Location != "" {
+				assert.Equal(tc.Location, rec.Result().Header.Get(headerLocation))
+			}
+		})
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	for _, i := range []string{
+		"errors/404.html",
+		"errors/404.html.gz",
+		"errors/405.html",
+		"site/index.html",
+		"site/errors/404.html",
+		"broken/index.html",
+		"private/index.html",
+	} {
+		p := filepath.Join(rootDir, filepath.FromSlash(i))
+		assert.NoError(os.MkdirAll(filepath.Dir(p), 0o755))
+		assert.NoError(os.WriteFile(p, []byte(i), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+		Instance: "testinstance",
+		ErrorPages: ErrorPages{
+			Pages: map[string]string{
+				"404": "errors/404.html",
+				"405": "errors/405.html",
+			},
+			Encodings: []Encoding{
+				{Code: "gzip", Ext: ".gz"},
+			},
+		},
+	})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix: "/site/",
+			Dir:    true,
+			Path:   "site",
+			ErrorPages: map[string]string{
+				"404": "errors/404.html",
+			},
+		},
+		{
+			Prefix: "/broken/",
+			Dir:    true,
+			Path:   "broken",
+			ErrorPages: map[string]string{
+				"404": "missing.html",
+			},
+		},
+		{
+			Prefix:      "/private/",
+			Dir:         true,
+			Path:        "private",
+			ProblemJSON: true,
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name           string
+		Method         string
+		Path           string
+		AcceptEncoding string
+		Status         int
+		Body           string
+		Encoding       string
+		ContentType    string
+	}{
+		{
+			Name:        "route error page",
+			Path:        "/site/bogus.html",
+			Status:      http.StatusNotFound,
+			Body:        "site/errors/404.html",
+			ContentType: "text/html; charset=utf-8",
+		},
+		{
+			Name:           "default error page",
+			Path:           "/bogus",
+			AcceptEncoding: "gzip",
+			Status:         http.StatusNotFound,
+			Body:           "errors/404.html.gz",
+			Encoding:       "gzip",
+			ContentType:    "text/html; charset=utf-8",
+		},
+		{
+			Name:        "default error page for methods",
+			Method:      http.MethodPost,
+			Path:        "/site/index.html",
+			Status:      http.StatusMethodNotAllowed,
+			Body:        "errors/405.html",
+			ContentType: "text/html; charset=utf-8",
+		},
+		{
+			Name:        "falls back when route page is missing",
+			Path:        "/broken/bogus.html",
+			Status:      http.StatusNotFound,
+			Body:        "errors/404.html",
+			ContentType: "text/html; charset=utf-8",
+		},
+		{
+			Name:        "problem json",
+			Path:        "/private/bogus.html",
+			Status:      http.StatusNotFound,
+			ContentType: "application/problem+json",
+		},
+		{
+			Name:        "plain text without a page",
+			Path:        "/site/",
+			Status:      http.StatusBadRequest,
+			Body:        "Bad Request\n",
+			ContentType: "text/plain; charset=utf-8",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			method := tc.Method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tc.Path, nil)
+			if tc.AcceptEncoding != "" {
+				req.Header.Set(headerAcceptEncoding, tc.AcceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+			assert.Equal(tc.ContentType, rec.Result().Header.Get(headerContentType))
+			assert.Equal(tc.Encoding, rec.Result().Header.Get(headerContentEncoding))
+			if tc.ContentType == "application/problem+json" {
+				var problem resProblem
+				assert.NoError(kjson.Unmarshal(rec.Body.Bytes(), &problem))
+				assert.Equal(tc.Status, problem.Status)
+				assert.Equal("Not Found", problem.Title)
+				assert.True(strings.HasSuffix(problem.LReqID, "testinstance"))
+				return
+			}
+			assert.Equal(tc.Body, rec.Body.String())
+		})
+	}
+
+	t.Run("redirects subtree routes", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/site", nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Contains([]int{http.StatusMovedPermanently, http.StatusTemporaryRedirect}, rec.Code)
+		assert.Equal("/site/", rec.Result().Header.Get(headerLocation))
+	})
+}
+
+func TestRules(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	for _, i := range []string{"static/new.html", "static/docs/v2/guide.html", "static/app.html"} {
+		p := filepath.Join(rootDir, filepath.FromSlash(i))
+		assert.NoError(os.MkdirAll(filepath.Dir(p), 0o755))
+		assert.NoError(os.WriteFile(p, []byte(i), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	routes := []Route{
+		{
+			Prefix: "/static/",
+			Dir:    true,
+			Path:   "static",
+		},
+	}
+	assert.NoError(server.Reload(routes, Rules{
+		Redirects: []Rule{
+			{From: "/old.html", To: "/static/new.html", Status: http.StatusMovedPermanently},
+			{Match: "prefix", From: "/docs/v1/", To: "/static/docs/v2/"},
+			{Match: "regex", From: `^/blog/(?P<year>\d{4})/(\w+)$`, To: "/posts/${year}-$2?from=blog", Status: http.StatusPermanentRedirect},
+			{Match: "prefix", From: "/old/", To: "/"},
+			{Match: "regex", From: `^/go/(.*)$`, To: "/$1"},
+			{Match: "prefix", From: "/old", To: "/static/archive"},
+		},
+		Rewrites: []Rule{
+			{From: "/app", To: "/static/app.html"},
+			{Match: "prefix", From: "/v2/", To: "/static/docs/v2/"},
+			{Match: "regex", From: `^/guide/(\w+)$`, To: "/static/docs/v2/$1.html"},
+		},
+	}, nil, Globals{}))
+
+	for _, tc := range []struct {
+		Name     string
+		Path     string
+		Status   int
+		Location string
+		Body     string
+	}{
+		{
+			Name:     "exact redirect",
+			Path:     "/old.html",
+			Status:   http.StatusMovedPermanently,
+			Location: "/static/new.html",
+		},
+		{
+			Name:     "prefix redirect keeps query",
+			Path:     "/docs/v1/guide.html?q=1",
+			Status:   http.StatusFound,
+			Location: "/static/docs/v2/guide.html?q=1",
+		},
+		{
+			Name:     "regex redirect substitutes captures",
+			Path:     "/blog/2024/hello",
+			Status:   http.StatusPermanentRedirect,
+			Location: "/posts/2024-hello?from=blog",
+		},
+		{
+			Name:     "prefix redirect may not target another host",
+			Path:     "/old//evil.com",
+			Status:   http.StatusFound,
+			Location: "/evil.com",
+		},
+		{
+			Name:     "regex redirect may not target another host",
+			Path:     "/go//evil.com",
+			Status:   http.StatusFound,
+			Location: "/evil.com",
+		},
+		{
+			Name:     "regex redirect may not target another host with backslashes",
+			Path:     `/go/%5C%5Cevil.com`,
+			Status:   http.StatusFound,
+			Location: "/evil.com",
+		},
+		{
+			Name:   "unmatched exact",
+			Path:   "/old.html/extra",
+			Status: http.StatusNotFound,
+		},
+		{
+			Name:     "prefix redirect without trailing slash",
+			Path:     "/old",
+			Status:   http.StatusFound,
+			Location: "/static/archive",
+		},
+		{
+			Name:   "prefix redirect matches whole segments",
+			Path:   "/older/x",
+			Status: http.StatusNotFound,
+		},
+		{
+			Name:   "exact rewrite",
+			Path:   "/app",
+			Status: http.StatusOK,
+			Body:   "static/app.html",
+		},
+		{
+			Name:   "prefix rewrite",
+			Path:   "/v2/guide.html",
+			Status: http.StatusOK,
+			Body:   "static/docs/v2/guide.html",
+		},
+		{
+			Name:   "regex rewrite",
+			Path:   "/guide/guide",
+			Status: http.StatusOK,
+			Body:   "static/docs/v2/guide.html",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+			if tc.Location != "" {
+				assert.Equal(tc.Location, rec.Result().Header.Get(headerLocation))
+			}
+			if tc.Body != "" {
+				assert.Equal(tc.Body, rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		for _, i := range []Rules{
+			{Redirects: []Rule{{Match: "regex", From: `(`, To: "/"}}},
+			{Redirects: []Rule{{From: "/a", To: "/b", Status: http.StatusOK}}},
+			{Redirects: []Rule{{Match: "bogus", From: "/a", To: "/b"}}},
+			{Rewrites: []Rule{{From: "/a", To: "b"}}},
+		} {
+			assert.Error(server.Reload(routes, i, nil, Globals{}))
+		}
+	})
+}
+
+func TestControlFiles(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	for k, v := range map[string]string{
+		"site/index.html":      "index",
+		"site/new.html":        "new",
+		"site/shadowed.html":   "shadowed",
+		"site/app/index.html":  "app",
+		"site/assets/main.css": "css",
+		"site/_redirects": `
+# comment
+/old.html        /new.html
+/shadowed.html   /new.html
+/forced.html     /new.html   302!
+/blog/:year/:slug /posts/:year/:slug.html 308
+/ext/*           https://example.com/:splat
+/app/*           /app/index.html 200
+`,
+		"site/_headers": `
+/*
+  X-Frame-Options: DENY
+/assets/*
+  Cache-Control: public, max-age=31536000, immutable
+  X-Custom: a
+  X-Custom: b
+`,
+	} {
+		p := filepath.Join(rootDir, filepath.FromSlash(k))
+		assert.NoError(os.MkdirAll(filepath.Dir(p), 0o755))
+		assert.NoError(os.WriteFile(p, []byte(v), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/site/",
+			Dir:          true,
+			Path:         "site",
+			DirList:      true,
+			ControlFiles: true,
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name     string
+		Path     string
+		Status   int
+		Location string
+		Body     string
+		Headers  map[string][]string
+	}{
+		{
+			Name:     "redirect",
+			Path:     "/site/old.html?q=1",
+			Status:   http.StatusMovedPermanently,
+			Location: "/site/new.html?q=1",
+		},
+		{
+			Name:   "shadowed redirect",
+			Path:   "/site/shadowed.html",
+			Status: http.StatusOK,
+			Body:   "shadowed",
+		},
+		{
+			Name:     "forced redirect",
+			Path:     "/site/forced.html",
+			Status:   http.StatusFound,
+			Location: "/site/new.html",
+		},
+		{
+			Name:     "placeholders",
+			Path:     "/site/blog/2024/hello",
+			Status:   http.StatusPermanentRedirect,
+			Location: "/site/posts/2024/hello.html",
+		},
+		{
+			Name:     "splat to external url",
+			Path:     "/site/ext/a/b",
+			Status:   http.StatusMovedPermanently,
+			Location: "https://example.com/a/b",
+		},
+		{
+			Name:   "rewrite",
+			Path:   "/site/app/some/route",
+			Status: http.StatusOK,
+			Body:   "app",
+		},
+		{
+			Name:   "headers",
+			Path:   "/site/assets/main.css",
+			Status: http.StatusOK,
+			Body:   "css",
+			Headers: map[string][]string{
+				"X-Frame-Options": {"DENY"},
+				"Cache-Control":   {"public, max-age=31536000, immutable"},
+				"X-Custom":        {"a", "b"},
+			},
+		},
+		{
+			Name:   "hides redirects file",
+			Path:   "/site/_redirects",
+			Status: http.StatusNotFound,
+		},
+		{
+			Name:   "hides headers file",
+			Path:   "/site/_headers",
+			Status: http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+			if tc.Location != "" {
+				assert.Equal(tc.Location, rec.Result().Header.Get(headerLocation))
+			}
+			if tc.Body != "" {
+				assert.Equal(tc.Body, rec.Body.String())
+			}
+			for k, v := range tc.Headers {
+				assert.Equal(v, rec.Result().Header.Values(k))
+			}
+		})
+	}
+
+	t.Run("hides control files from listings", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/site/?dir=t", nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		var listing resDirListing
+		assert.NoError(kjson.Unmarshal(rec.Body.Bytes(), &listing))
+		var names []string
+		for _, i := range listing.Entries {
+			names = append(names, i.Name)
+		}
+		assert.Equal([]string{"app", "assets", "index.html", "new.html", "shadowed.html"}, names)
+	})
+
+	t.Run("splat may not target another host", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		rootDir := t.TempDir()
+		assert.NoError(os.WriteFile(filepath.Join(rootDir, "_redirects"), []byte("/old/* /:splat 301!\n"), 0o644))
+		server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+		assert.NoError(server.Mount([]Route{
+			{
+				Prefix:       "/",
+				Dir:          true,
+				Path:         ".",
+				ControlFiles: true,
+			},
+		}))
+
+		for _, i := range []string{"/old/%2Fevil.com", "/old/%5Cevil.com"} {
+			req := httptest.NewRequest(http.MethodGet, i, nil)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(http.StatusMovedPermanently, rec.Code)
+			assert.Equal("/evil.com", rec.Result().Header.Get(headerLocation))
+		}
+	})
+
+	t.Run("rejects invalid control files", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		badDir := t.TempDir()
+		assert.NoError(os.WriteFile(filepath.Join(badDir, "_redirects"), []byte("/a /b 200 extra"), 0o644))
+		server := NewServer(klog.Discard{}, kfs.DirFS(badDir), Config{Instance: "testinstance"})
+		assert.Error(server.Mount([]Route{
+			{
+				Prefix:       "/",
+				Dir:          true,
+				Path:         ".",
+				ControlFiles: true,
+			},
+		}))
+	})
+}
+
+func TestRouteHeaders(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(rootDir, "static", "fonts"), 0o755))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "static", "index.html"), []byte("index"), 0o644))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "static", "fonts", "main.woff2"), []byte("font"), 0o644))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/static/",
+			Dir:          true,
+			Path:         "static",
+			CacheControl: "public, max-age=60",
+			DisableXAttr: true,
+			Headers: []HeaderRule{
+				{
+					Headers: map[string]string{
+						"x-content-type-options": "nosniff",
+						"Referrer-Policy":        "no-referrer",
+					},
+				},
+				{
+					Match: `\.html$`,
+					Headers: map[string]string{
+						"Content-Security-Policy": "default-src 'self'",
+						"Referrer-Policy":         "same-origin",
+					},
+				},
+			},
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name    string
+		Path    string
+		Headers map[string]string
+	}{
+		{
+			Name: "html",
+			Path: "/static/index.html",
+			Headers: map[string]string{
+				"X-Content-Type-Options":  "nosniff",
+				"Referrer-Policy":         "same-origin",
+				"Content-Security-Policy": "default-src 'self'",
+			},
+		},
+		{
+			Name: "font",
+			Path: "/static/fonts/main.woff2",
+			Headers: map[string]string{
+				"X-Content-Type-Options":  "nosniff",
+				"Referrer-Policy":         "no-referrer",
+				"Content-Security-Policy": "",
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(http.StatusOK, rec.Code)
+			for k, v := range tc.Headers {
+				assert.Equal(v, rec.Result().Header.Get(k))
+			}
+			etag := rec.Result().Header.Get(headerETag)
+			assert.NotEqual("", etag)
+
+			req = httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			req.Header.Set(headerIfNoneMatch, etag)
+			rec = httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(http.StatusNotModified, rec.Code)
+			for k, v := range tc.Headers {
+				assert.Equal(v, rec.Result().Header.Get(k))
+			}
+		})
+	}
+
+	t.Run("strips headers on errors", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/static/index.html", nil)
+		rec := httptest.NewRecorder()
+		w := (&errorPageSet{}).wrap(rec, req)
+		w.Header().Set("X-Keep", "keep")
+		writeResHeaders(w, req.Header, fileConfig{
+			ctype: mediaTypeHTML,
+			headers: http.Header{
+				"Content-Security-Policy": {"default-src 'self'"},
+			},
+		})
+		writeError(context.Background(), klog.NewLevelLogger(klog.Discard{}), w, kerrors.WithKind(nil, ErrNotFound, "Not found"))
+		assert.Equal(http.StatusNotFound, rec.Code)
+		assert.Equal("", rec.Result().Header.Get("Content-Security-Policy"))
+		assert.Equal("keep", rec.Result().Header.Get("X-Keep"))
+	})
+
+	t.Run("rejects invalid header rules", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		assert.Error(parseRoutes([]Route{
+			{
+				Prefix:  "/",
+				Path:    ".",
+				Headers: []HeaderRule{{Headers: map[string]string{"X-Bad": "a\r\nb"}}},
+			},
+		}))
+	})
+}
+
+func TestCacheControlRules(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(rootDir, "static"), 0o755))
+	for _, i := range []string{"index.html", "main.0123abcd.js", "robots.txt"} {
+		assert.NoError(os.WriteFile(filepath.Join(rootDir, "static", i), []byte(i), 0o644))
+	}
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/static/",
+			Dir:          true,
+			Path:         "static",
+			CacheControl: "public, max-age=3600",
+			CacheControlRules: []CacheControlRule{
+				{
+					Match:        `\.[0-9a-f]{8}\.js$`,
+					CacheControl: "public, max-age=31536000, immutable",
+				},
+				{
+					Match:        `\.html$`,
+					CacheControl: "no-cache",
+				},
+				{
+					Match:        `\.js$`,
+					CacheControl: "unused",
+				},
+			},
+			DisableXAttr: true,
+		},
+		{
+			Prefix:       "/nocache/",
+			Dir:          true,
+			Path:         "static",
+			DisableXAttr: true,
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name         string
+		Path         string
+		CacheControl string
+	}{
+		{
+			Name:         "hashed bundle",
+			Path:         "/static/main.0123abcd.js",
+			CacheControl: "public, max-age=31536000, immutable",
+		},
+		{
+			Name:         "html",
+			Path:         "/static/index.html",
+			CacheControl: "no-cache",
+		},
+		{
+			Name:         "route default",
+			Path:         "/static/robots.txt",
+			CacheControl: "public, max-age=3600",
+		},
+		{
+			Name:         "etag without cache control",
+			Path:         "/nocache/robots.txt",
+			CacheControl: "",
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(http.StatusOK, rec.Code)
+			assert.Equal(tc.CacheControl, rec.Result().Header.Get(headerCacheControl))
+			etag := rec.Result().Header.Get(headerETag)
+			assert.NotEqual("", etag)
+
+			req = httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			req.Header.Set(headerIfNoneMatch, etag)
+			rec = httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(http.StatusNotModified, rec.Code)
+			assert.Equal(tc.CacheControl, rec.Result().Header.Get(headerCacheControl))
+			assert.Equal(etag, rec.Result().Header.Get(headerETag))
+		})
+	}
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		assert.Error(parseRoutes([]Route{
+			{
+				Prefix:            "/",
+				Path:              ".",
+				CacheControlRules: []CacheControlRule{{Match: "(", CacheControl: "no-cache"}},
+			},
+		}))
+	})
+}
+
+func TestCORS(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(rootDir, "static"), 0o755))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "static", "font.woff2"), []byte("font"), 0o644))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/static/",
+			Dir:          true,
+			Path:         "static",
+			DisableXAttr: true,
+			CORS: CORS{
+				Origins:          []string{"https://example.com"},
+				OriginPatterns:   []string{`^https://[a-z]+\.example\.org$`},
+				AllowHeaders:     []string{"Range"},
+				ExposeHeaders:    []string{"Content-Length", "ETag"},
+				AllowCredentials: true,
+				MaxAge:           600,
+			},
+		},
+		{
+			Prefix:       "/public/",
+			Dir:          true,
+			Path:         "static",
+			DisableXAttr: true,
+			CORS: CORS{
+				Origins: []string{"*"},
+			},
+		},
+		{
+			Prefix:       "/nocors/",
+			Dir:          true,
+			Path:         "static",
+			DisableXAttr: true,
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name    string
+		Method  string
+		Path    string
+		Headers map[string]string
+		Status  int
+		Res     map[string]string
+		Vary    []string
+	}{
+		{
+			Name:   "exact origin",
+			Method: http.MethodGet,
+			Path:   "/static/font.woff2",
+			Headers: map[string]string{
+				headerOrigin: "https://example.com",
+			},
+			Status: http.StatusOK,
+			Res: map[string]string{
+				headerAccessControlAllowOrigin:      "https://example.com",
+				headerAccessControlAllowCredentials: "true",
+				headerAccessControlExposeHeaders:    "Content-Length, ETag",
+			},
+			Vary: []string{headerOrigin, headerAcceptEncoding},
+		},
+		{
+			Name:   "origin pattern",
+			Method: http.MethodGet,
+			Path:   "/static/font.woff2",
+			Headers: map[string]string{
+				headerOrigin: "https://cdn.example.org",
+			},
+			Status: http.StatusOK,
+			Res: map[string]string{
+				headerAccessControlAllowOrigin: "https://cdn.example.org",
+			},
+			Vary: []string{headerOrigin, headerAcceptEncoding},
+		},
+		{
+			Name:   "disallowed origin",
+			Method: http.MethodGet,
+			Path:   "/static/font.woff2",
+			Headers: map[string]string{
+				headerOrigin: "https://evil.example.net",
+			},
+			Status: http.StatusOK,
+			Res: map[string]string{
+				headerAccessControlAllowOrigin: "",
+			},
+			Vary: []string{headerOrigin, headerAcceptEncoding},
+		},
+		{
+			Name:   "error keeps cors headers",
+			Method: http.MethodGet,
+			Path:   "/static/missing.woff2",
+			Headers: map[string]string{
+				headerOrigin: "https://example.com",
+			},
+			Status: http.StatusNotFound,
+			Res: map[string]string{
+				headerAccessControlAllowOrigin: "https://example.com",
+			},
+			Vary: []string{headerOrigin},
+		},
+		{
+			Name:   "preflight",
+			Method: http.MethodOptions,
+			Path:   "/static/font.woff2",
+			Headers: map[string]string{
+				headerOrigin:                      "https://example.com",
+				headerAccessControlRequestMethod:  http.MethodGet,
+				headerAccessControlRequestHeaders: "range",
+			},
+			Status: http.StatusNoContent,
+			Res: map[string]string{
+				headerAccessControlAllowOrigin:      "https://example.com",
+				headerAccessControlAllowCredentials: "true",
+				headerAccessControlAllowMethods:     "GET, HEAD",
+				headerAccessControlAllowHeaders:     "Range",
+				headerAccessControlMaxAge:           "600",
+				headerAllow:                         "GET, HEAD, OPTIONS",
+			},
+			Vary: []string{headerOrigin, headerAccessControlRequestMethod, headerAccessControlRequestHeaders},
+		},
+		{
+			Name:   "preflight disallowed method",
+			Method: http.MethodOptions,
+			Path:   "/static/font.woff2",
+			Headers: map[string]string{
+				headerOrigin:                     "https://example.com",
+				headerAccessControlRequestMethod: http.MethodPut,
+			},
+			Status: http.StatusNoContent,
+			Res: map[string]string{
+				headerAccessControlAllowOrigin:  "",
+				headerAccessControlAllowMethods: "",
+			},
+			Vary: []string{headerOrigin, headerAccessControlRequestMethod, headerAccessControlRequestHeaders},
+		},
+		{
+			Name:   "all origins",
+			Method: http.MethodGet,
+			Path:   "/public/font.woff2",
+			Headers: map[string]string{
+				headerOrigin: "https://anywhere.example.net",
+			},
+			Status: http.StatusOK,
+			Res: map[string]string{
+				headerAccessControlAllowOrigin:      "*",
+				headerAccessControlAllowCredentials: "",
+			},
+			Vary: []string{headerOrigin, headerAcceptEncoding},
+		},
+		{
+			Name:   "options without cors",
+			Method: http.MethodOptions,
+			Path:   "/nocors/font.woff2",
+			Headers: map[string]string{
+				headerOrigin:                     "https://example.com",
+				headerAccessControlRequestMethod: http.MethodGet,
+			},
+			Status: http.StatusNoContent,
+			Res: map[string]string{
+				headerAccessControlAllowOrigin: "",
+				headerAllow:                    "GET, HEAD, OPTIONS",
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(tc.Method, tc.Path, nil)
+			for k, v := range tc.Headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+			for k, v := range tc.Res {
+				assert.Equal(v, rec.Result().Header.Get(k), k)
+			}
+			assert.Equal(tc.Vary, rec.Result().Header.Values(headerVary))
+		})
+	}
+
+	t.Run("rejects credentials for all origins", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		assert.Error(parseRoutes([]Route{
+			{
+				Prefix: "/",
+				Path:   ".",
+				CORS: CORS{
+					Origins:          []string{"*"},
+					AllowCredentials: true,
+				},
+			},
+		}))
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "index.html"), []byte("index"), 0o644))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+		Instance: "testinstance",
+		Proxies:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		RateLimit: RateLimit{
+			Rate:  1,
+			Burst: 3,
+			Allow: []string{"192.0.2.0/24"},
+		},
+	})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/limited",
+			Path:         "index.html",
+			DisableXAttr: true,
+			RateLimit: RateLimit{
+				Rate:  0.5,
+				Burst: 1,
+			},
+		},
+		{
+			Prefix:       "/",
+			Path:         "index.html",
+			DisableXAttr: true,
+		},
+	}))
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	server.limiter.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	get := func(p string, realip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(headerXForwardedFor, realip)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for range 3 {
+		assert.Equal(http.StatusOK, get("/", "203.0.113.1").Code)
+	}
+	rec := get("/", "203.0.113.1")
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	assert.Equal("1", rec.Result().Header.Get(headerRetryAfter))
+	assert.Equal("3", rec.Result().Header.Get(headerRateLimitLimit))
+	assert.Equal("0", rec.Result().Header.Get(headerRateLimitRemaining))
+	assert.Equal("3", rec.Result().Header.Get(headerRateLimitReset))
+	assert.Equal("3;w=3", rec.Result().Header.Get(headerRateLimitPolicy))
+
+	// buckets are keyed on the real ip
+	assert.Equal(http.StatusOK, get("/", "203.0.113.2").Code)
+
+	// allowed prefixes are not limited
+	for range 5 {
+		assert.Equal(http.StatusOK, get("/", "192.0.2.1").Code)
+	}
+
+	advance(time.Second)
+	assert.Equal(http.StatusOK, get("/", "203.0.113.1").Code)
+	assert.Equal(http.StatusTooManyRequests, get("/", "203.0.113.1").Code)
+
+	// route limits apply in addition to the global limit
+	assert.Equal(http.StatusOK, get("/limited", "203.0.113.3").Code)
+	rec = get("/limited", "203.0.113.3")
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	assert.Equal("2", rec.Result().Header.Get(headerRetryAfter))
+
+	// idle buckets are removed once refilled
+	advance(rateLimitSweepInterval)
+	assert.Equal(http.StatusOK, get("/", "203.0.113.4").Code)
+	server.limiter.mu.Lock()
+	assert.Len(server.limiter.buckets, 1)
+	server.limiter.mu.Unlock()
+
+	// requests with an unknown real ip share a bucket
+	getUnix := func(realip string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ""
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "fsserve.sock", Net: "unix"}))
+		if realip != "" {
+			req.Header.Set(headerXForwardedFor, realip)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for range 3 {
+		assert.Equal(http.StatusOK, getUnix(""))
+	}
+	assert.Equal(http.StatusTooManyRequests, getUnix(""))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "bogus"
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	// unix socket requests are limited by their forwarded real ip
+	assert.Equal(http.StatusOK, getUnix("203.0.113.5"))
+
+	assert.Error(parseRateLimit(&RateLimit{Rate: 1, Allow: []string{"bogus"}}, "test"))
+	assert.Error(parseRateLimit(&RateLimit{Rate: -1}, "test"))
+}
+
+func TestIPFilter(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "index.html"), []byte("index"), 0o644))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+		Instance: "testinstance",
+		Proxies:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		IPFilter: IPFilter{
+			Deny: []string{"198.51.100.0/24"},
+		},
+	})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/internal",
+			Path:         "index.html",
+			DisableXAttr: true,
+			IPFilter: IPFilter{
+				Allow: []string{"203.0.113.0/24", "2001:db8::/32"},
+				Deny:  []string{"203.0.113.128/25"},
+			},
+		},
+		{
+			Prefix:       "/",
+			Path:         "index.html",
+			DisableXAttr: true,
+		},
+	}))
+
+	for _, tc := range []struct {
+		Name   string
+		Path   string
+		RealIP string
+		Unix   bool
+		Status int
+	}{
+		{
+			Name:   "public route",
+			Path:   "/",
+			RealIP: "192.0.2.1",
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "globally denied",
+			Path:   "/",
+			RealIP: "198.51.100.1",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "route allowed",
+			Path:   "/internal",
+			RealIP: "203.0.113.1",
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "route allowed ipv6",
+			Path:   "/internal",
+			RealIP: "2001:db8::1",
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "route denied within allowed",
+			Path:   "/internal",
+			RealIP: "203.0.113.200",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "route not allowed",
+			Path:   "/internal",
+			RealIP: "192.0.2.1",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "unix socket route allowed",
+			Path:   "/internal",
+			RealIP: "203.0.113.1",
+			Unix:   true,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "unix socket route not allowed",
+			Path:   "/internal",
+			RealIP: "192.0.2.1",
+			Unix:   true,
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "unix socket globally denied",
+			Path:   "/",
+			RealIP: "198.51.100.1",
+			Unix:   true,
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "unix socket through trusted proxy",
+			Path:   "/",
+			RealIP: "198.51.100.1, 10.0.0.2",
+			Unix:   true,
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "unix socket public route",
+			Path:   "/",
+			RealIP: "192.0.2.1",
+			Unix:   true,
+			Status: http.StatusOK,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			if tc.Unix {
+				// unix socket peers are unnamed
+				req.RemoteAddr = ""
+				req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "fsserve.sock", Net: "unix"}))
+			}
+			req.Header.Set(headerXForwardedFor, tc.RealIP)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+		})
+	}
+
+	t.Run("rejects invalid prefixes", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		assert.Error(parseRoutes([]Route{
+			{
+				Prefix: "/",
+				Path:   "index.html",
+				IPFilter: IPFilter{
+					Allow: []string{"203.0.113.1"},
+				},
+			},
+		}))
+	})
+
+	t.Run("reloads global filter", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+			Instance: "testinstance",
+			IPFilter: IPFilter{
+				Deny: []string{"198.51.100.0/24"},
+			},
+		})
+		routes := []Route{
+			{
+				Prefix:       "/",
+				Path:         "index.html",
+				DisableXAttr: true,
+			},
+		}
+		assert.NoError(server.Mount(routes))
+
+		get := func(remoteAddr string) int {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = remoteAddr
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		assert.Equal(http.StatusForbidden, get("198.51.100.1:1234"))
+		assert.Equal(http.StatusOK, get("192.0.2.1:1234"))
+
+		assert.NoError(server.Reload(routes, Rules{}, nil, Globals{
+			IPFilter: IPFilter{
+				Deny: []string{"192.0.2.0/24"},
+			},
+		}))
+		assert.Equal(http.StatusOK, get("198.51.100.1:1234"))
+		assert.Equal(http.StatusForbidden, get("192.0.2.1:1234"))
+
+		// mounting keeps the reloaded globals
+		assert.NoError(server.Mount(routes))
+		assert.Equal(http.StatusForbidden, get("192.0.2.1:1234"))
+
+		assert.Error(server.Reload(routes, Rules{}, nil, Globals{
+			IPFilter: IPFilter{
+				Deny: []string{"bogus"},
+			},
+		}))
+		assert.Equal(http.StatusForbidden, get("192.0.2.1:1234"))
+	})
+}
+
+func TestAuth(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "index.html"), []byte("index"), 0o644))
+
+	credDir := t.TempDir()
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-password"), bcrypt.MinCost)
+	assert.NoError(err)
+	salt := []byte("0123456789abcdef")
+	argonKey := argon2.IDKey([]byte("argon-password"), salt, 1, 64, 1, 32)
+	argonHash := fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(argonKey))
+	basicFile := filepath.Join(credDir, "htpasswd")
+	assert.NoError(os.WriteFile(basicFile, []byte("# users\nalice:"+string(bcryptHash)+"\nbob:"+argonHash+"\n"), 0o600))
+	tokenFile := filepath.Join(credDir, "tokens")
+	assert.NoError(os.WriteFile(tokenFile, []byte("ci:file-token\n"), 0o600))
+	tokenEnv := "FSSERVE_TEST_AUTH_TOKEN"
+	assert.NoError(os.Setenv(tokenEnv, "env-token"))
+	t.Cleanup(func() {
+		_ = os.Unsetenv(tokenEnv)
+	})
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/basic",
+			Path:         "index.html",
+			DisableXAttr: true,
+			Auth: Auth{
+				Realm:     "files",
+				BasicFile: basicFile,
+			},
+		},
+		{
+			Prefix:       "/token",
+			Path:         "index.html",
+			DisableXAttr: true,
+			Auth: Auth{
+				TokenFiles: []string{tokenFile},
+				TokenEnvs:  []string{tokenEnv},
+			},
+		},
+		{
+			Prefix:       "/",
+			Path:         "index.html",
+			DisableXAttr: true,
+		},
+	}))
+
+	basic := func(user, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+
+	for _, tc := range []struct {
+		Name      string
+		Path      string
+		Auth      string
+		Status    int
+		Challenge []string
+	}{
+		{
+			Name:   "unauthenticated route",
+			Path:   "/",
+			Status: http.StatusOK,
+		},
+		{
+			Name:      "missing basic credentials",
+			Path:      "/basic",
+			Status:    http.StatusUnauthorized,
+			Challenge: []string{`Basic realm="files", charset="UTF-8"`},
+		},
+		{
+			Name:   "bcrypt password",
+			Path:   "/basic",
+			Auth:   basic("alice", "bcrypt-password"),
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "argon2id password",
+			Path:   "/basic",
+			Auth:   basic("bob", "argon-password"),
+			Status: http.StatusOK,
+		},
+		{
+			Name:      "wrong password",
+			Path:      "/basic",
+			Auth:      basic("alice", "argon-password"),
+			Status:    http.StatusUnauthorized,
+			Challenge: []string{`Basic realm="files", charset="UTF-8"`},
+		},
+		{
+			Name:      "unknown user",
+			Path:      "/basic",
+			Auth:      basic("mallory", "bcrypt-password"),
+			Status:    http.StatusUnauthorized,
+			Challenge: []string{`Basic realm="files", charset="UTF-8"`},
+		},
+		{
+			Name:      "bearer on basic route",
+			Path:      "/basic",
+			Auth:      "Bearer file-token",
+			Status:    http.StatusUnauthorized,
+			Challenge: []string{`Basic realm="files", charset="UTF-8"`},
+		},
+		{
+			Name:   "file token",
+			Path:   "/token",
+			Auth:   "Bearer file-token",
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "env token",
+			Path:   "/token",
+			Auth:   "bearer env-token",
+			Status: http.StatusOK,
+		},
+		{
+			Name:      "invalid token",
+			Path:      "/token",
+			Auth:      "Bearer bogus",
+			Status:    http.StatusUnauthorized,
+			Challenge: []string{`Bearer realm="fsserve", error="invalid_token"`},
+		},
+		{
+			Name:      "missing token",
+			Path:      "/token",
+			Status:    http.StatusUnauthorized,
+			Challenge: []string{`Bearer realm="fsserve"`},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			if tc.Auth != "" {
+				req.Header.Set(headerAuthorization, tc.Auth)
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+			assert.Equal(tc.Challenge, rec.Result().Header.Values(headerWWWAuthenticate))
+			if tc.Status == http.StatusOK {
+				assert.Equal("index", rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("logs principal", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		var b bytes.Buffer
+		server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+			Instance:        "testinstance",
+			AccessLog:       AccessLog{Format: "common"},
+			AccessLogWriter: &b,
+		})
+		assert.NoError(server.Mount([]Route{
+			{
+				Prefix:       "/",
+				Path:         "index.html",
+				DisableXAttr: true,
+				Auth: Auth{
+					TokenFiles: []string{tokenFile},
+				},
+			},
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(headerAuthorization, "Bearer file-token")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Regexp(`^\S+ - token:ci \[`, b.String())
+
+		b.Reset()
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		rec = httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(http.StatusUnauthorized, rec.Code)
+		assert.Regexp(`^\S+ - - \[`, b.String())
+	})
+
+	t.Run("rejects invalid credentials files", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		badFile := filepath.Join(t.TempDir(), "htpasswd")
+		assert.NoError(os.WriteFile(badFile, []byte("alice:plaintext\n"), 0o600))
+		server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+		assert.Error(server.Mount([]Route{
+			{
+				Prefix: "/",
+				Path:   "index.html",
+				Auth: Auth{
+					BasicFile: badFile,
+				},
+			},
+		}))
+		assert.Error(server.Mount([]Route{
+			{
+				Prefix: "/",
+				Path:   "index.html",
+				Auth: Auth{
+					TokenEnvs: []string{"FSSERVE_TEST_AUTH_TOKEN_UNSET"},
+				},
+			},
+		}))
+	})
+}
+
+func TestSignedURL(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(rootDir, "downloads"), 0o755))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "downloads", "report a.txt"), []byte("report"), 0o644))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "downloads", "other.txt"), []byte("other"), 0o644))
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+		Instance: "testinstance",
+		SignKey:  key,
+	})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/dl/",
+			Dir:          true,
+			Path:         "downloads",
+			DisableXAttr: true,
+			Signed:       true,
+		},
+	}))
+
+	valid, err := SignURL(key, "/dl/report a.txt", time.Now().Add(time.Hour))
+	assert.NoError(err)
+	expired, err := SignURL(key, "/dl/report a.txt", time.Now().Add(-time.Second))
+	assert.NoError(err)
+	other, err := SignURL(key, "/dl/other.txt", time.Now().Add(time.Hour))
+	assert.NoError(err)
+	otherKey, err := SignURL([]byte("fedcba9876543210fedcba9876543210"), "/dl/report a.txt", time.Now().Add(time.Hour))
+	assert.NoError(err)
+	otherURL, err := url.Parse(other)
+	assert.NoError(err)
+	withQuery, err := SignURL(key, "/dl/report a.txt?download=1", time.Now().Add(time.Hour))
+	assert.NoError(err)
+	_, err = SignURL(key, "/dl/report a.txt?exp=1", time.Now().Add(time.Hour))
+	assert.Error(err)
+
+	for _, tc := range []struct {
+		Name   string
+		Path   string
+		Status int
+	}{
+		{
+			Name:   "valid",
+			Path:   valid,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "expired",
+			Path:   expired,
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "unsigned",
+			Path:   "/dl/report%20a.txt",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "signature of another path",
+			Path:   "/dl/report%20a.txt?" + otherURL.RawQuery,
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "signed with another key",
+			Path:   otherKey,
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "signed query",
+			Path:   withQuery,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "added param",
+			Path:   valid + "&dir=t",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "tampered param",
+			Path:   strings.Replace(withQuery, "download=1", "download=2", 1),
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "removed param",
+			Path:   strings.Replace(withQuery, "download=1&", "", 1),
+			Status: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(tc.Status, rec.Code)
+			if tc.Status == http.StatusOK {
+				assert.Equal("report", rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("redacts signatures", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		u, err := url.Parse("/dl/report%20a.txt?exp=123&sig=secret")
+		assert.NoError(err)
+		assert.Equal("/dl/report%20a.txt?exp=123&sig=REDACTED", redactedReqPath(u))
+		u, err = url.Parse("/dl/report%20a.txt")
+		assert.NoError(err)
+		assert.Equal("/dl/report%20a.txt", redactedReqPath(u))
+	})
+
+	t.Run("requires a signing key", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+		assert.Error(server.Mount([]Route{
+			{
+				Prefix: "/dl/",
+				Dir:    true,
+				Path:   "downloads",
+				Signed: true,
+			},
+		}))
+		_, err := SignURL([]byte("short"), "/dl/other.txt", time.Now())
+		assert.Error(err)
+	})
+}
+
+func TestClientCert(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "artifact.tar"), []byte("artifact"), 0o644))
+
+	certDir := t.TempDir()
+	certFile := filepath.Join(certDir, "cert.pem")
+	keyFile := filepath.Join(certDir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "localhost")
+	certs, err := newCertReloader(klog.NewLevelLogger(klog.Discard{}), certFile, keyFile)
+	assert.NoError(err)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	now := time.Now()
+	spiffeID, err := url.Parse("spiffe://example.org/ci")
+	assert.NoError(err)
+	clientTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: "builder"},
+		URIs:                  []*url.URL{spiffeID},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	clientDer, err := x509.CreateCertificate(rand.Reader, clientTmpl, clientTmpl, &clientKey.PublicKey, clientKey)
+	assert.NoError(err)
+	caFile := filepath.Join(certDir, "clientca.pem")
+	assert.NoError(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientDer}), 0o644))
+	clientCAs, err := loadClientCAs([]string{caFile})
+	assert.NoError(err)
+	_, err = loadClientCAs([]string{keyFile})
+	assert.Error(err)
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/any",
+			Path:         "artifact.tar",
+			DisableXAttr: true,
+			ClientCert: ClientCert{
+				Required: true,
+			},
+		},
+		{
+			Prefix:       "/subject",
+			Path:         "artifact.tar",
+			DisableXAttr: true,
+			ClientCert: ClientCert{
+				Subjects: []string{"builder"},
+			},
+		},
+		{
+			Prefix:       "/san",
+			Path:         "artifact.tar",
+			DisableXAttr: true,
+			ClientCert: ClientCert{
+				SANs: []string{"spiffe://example.org/ci"},
+			},
+		},
+		{
+			Prefix:       "/other",
+			Path:         "artifact.tar",
+			DisableXAttr: true,
+			ClientCert: ClientCert{
+				Subjects: []string{"deployer"},
+				SANs:     []string{"spiffe://example.org/deploy"},
+			},
+		},
+		{
+			Prefix:       "/",
+			Path:         "artifact.tar",
+			DisableXAttr: true,
+		},
+	}))
+
+	ts := httptest.NewUnstartedServer(server)
+	ts.TLS = newTLSConfig(certs, TLSOpts{MinVersion: tls.VersionTLS12}, clientCAs)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	newClient := func(withCert bool) *http.Client {
+		tlsConfig := &tls.Config{
+			// server cert is not under test
+			InsecureSkipVerify: true,
+		}
+		if withCert {
+			tlsConfig.Certificates = []tls.Certificate{
+				{
+					Certificate: [][]byte{clientDer},
+					PrivateKey:  clientKey,
+				},
+			}
+		}
+		return &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+	withCert := newClient(true)
+	withoutCert := newClient(false)
+
+	for _, tc := range []struct {
+		Name   string
+		Path   string
+		Client *http.Client
+		Status int
+	}{
+		{
+			Name:   "public without cert",
+			Path:   "/",
+			Client: withoutCert,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "required without cert",
+			Path:   "/any",
+			Client: withoutCert,
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "required with cert",
+			Path:   "/any",
+			Client: withCert,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "subject allowed",
+			Path:   "/subject",
+			Client: withCert,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "san allowed",
+			Path:   "/san",
+			Client: withCert,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "identity not allowed",
+			Path:   "/other",
+			Client: withCert,
+			Status: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			res, err := tc.Client.Get(ts.URL + tc.Path)
+			assert.NoError(err)
+			defer func() {
+				assert.NoError(res.Body.Close())
+			}()
+			assert.Equal(tc.Status, res.StatusCode)
+			if tc.Status == http.StatusOK {
+				b, err := io.ReadAll(res.Body)
+				assert.NoError(err)
+				assert.Equal("artifact", string(b))
+			}
+		})
+	}
+
+	t.Run("rejects routes when client certs are not verified", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		routes := []Route{
+			{
+				Prefix:       "/",
+				Path:         "artifact.tar",
+				DisableXAttr: true,
+				ClientCert: ClientCert{
+					Required: true,
+				},
+			},
+		}
+
+		server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+		assert.NoError(server.Mount(routes))
+
+		// serve returns instead of serving routes which forbid every request
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			server.Serve(context.Background(), Opts{
+				Listeners: []Listener{
+					{Network: "tcp", Addr: "127.0.0.1:0"},
+				},
+				TLS: TLSOpts{
+					ClientCAFiles: []string{caFile},
+				},
+			})
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			assert.FailNow("Serve did not reject routes")
+		}
+
+		assert.Error(server.Mount(routes))
+		assert.Error(clientCertSupport{tlsListener: true}.checkRoutes(routes))
+		assert.Error(clientCertSupport{clientCA: true}.checkRoutes(routes))
+		assert.NoError(clientCertSupport{clientCA: true, tlsListener: true}.checkRoutes(routes))
+		assert.NoError(clientCertSupport{}.checkRoutes([]Route{
+			{
+				Prefix: "/",
+				Path:   "artifact.tar",
+			},
+		}))
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(rootDir, "static"), 0o755))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "static", "index.html"), []byte("hello"), 0o644))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{Instance: "testinstance"})
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix:       "/static/",
+			Dir:          true,
+			Path:         "static",
+			DisableXAttr: true,
+		},
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/static/index.html", nil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	etag := rec.Result().Header.Get(headerETag)
+
+	req = httptest.NewRequest(http.MethodGet, "/static/index.html", nil)
+	req.Header.Set(headerIfNoneMatch, etag)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNotModified, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/static/missing.html", nil)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNotFound, rec.Code)
+
+	var nilMetrics *serverMetrics
+	nilMetrics.observeXAttr(xattrResultHit)
+	server.metrics.observeXAttr(xattrResultStale)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	server.metrics.connState(c1, http.StateNew)
+	server.metrics.connState(c1, http.StateActive)
+	server.metrics.connState(c2, http.StateNew)
+	server.metrics.connState(c2, http.StateIdle)
+	server.metrics.connState(c2, http.StateClosed)
+
+	req = httptest.NewRequest(http.MethodGet, metricsPath, nil)
+	rec = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(mediaTypePrometheusText, rec.Result().Header.Get(headerContentType))
+	body := rec.Body.String()
+	for _, i := range []string{
+		`fsserve_http_requests_total{route="/static/",status="200",encoding="identity"} 1`,
+		`fsserve_http_requests_total{route="/static/",status="304",encoding="identity"} 1`,
+		`fsserve_http_response_bytes_total{route="/static/",status="200",encoding="identity"} 5`,
+		`fsserve_http_response_bytes_total{route="/static/",status="304",encoding="identity"} 0`,
+		`fsserve_http_request_duration_seconds_bucket{route="/static/",status="200",encoding="identity",le="+Inf"} 1`,
+		`fsserve_http_request_duration_seconds_count{route="/static/",status="200",encoding="identity"} 1`,
+		`fsserve_http_requests_in_flight 0`,
+		`fsserve_checksum_xattr_total{result="hit"} 0`,
+		`fsserve_checksum_xattr_total{result="stale"} 1`,
+		`fsserve_http_connections{state="new"} 0`,
+		`fsserve_http_connections{state="active"} 1`,
+		`fsserve_http_connections{state="idle"} 0`,
+	} {
+		assert.Contains(body, i+"\n")
+	}
+	assert.Regexp(`fsserve_http_requests_total\{route="/static/",status="404",encoding="identity"\} 1\n`, body)
+	assert.Regexp(`fsserve_http_not_modified_ratio\{route="/static/"\} 0\.\d+\n`, body)
+
+	req = httptest.NewRequest(http.MethodPost, metricsPath, nil)
+	rec = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(rec, req)
+	assert.Equal(http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestProbes(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(rootDir, "static"), 0o755))
+
+	server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+		Instance: "testinstance",
+		BuildInfo: BuildInfo{
+			Version:   "v1.2.3",
+			VCS:       "git-0123abcd",
+			GoVersion: "go1.22.0",
+		},
+	})
+
+	admin := server.adminHandler()
+	probe := func(h http.Handler, method, p string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := probe(admin, http.MethodGet, healthzPath)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("ok\n", rec.Body.String())
+	assert.Equal(http.StatusServiceUnavailable, probe(admin, http.MethodGet, readyzPath).Code)
+
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix: "/static/",
+			Dir:    true,
+			Path:   "static",
+		},
+	}))
+	assert.Equal(http.StatusOK, probe(admin, http.MethodGet, readyzPath).Code)
+	assert.Equal(http.StatusOK, probe(admin, http.MethodHead, readyzPath).Code)
+
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix: "/missing/",
+			Dir:    true,
+			Path:   "missing",
+		},
+	}))
+	assert.Equal(http.StatusServiceUnavailable, probe(admin, http.MethodGet, readyzPath).Code)
+	assert.Equal(http.StatusOK, probe(admin, http.MethodGet, healthzPath).Code)
+
+	for _, i := range []string{healthzPath, readyzPath, versionPath} {
+		assert.Equal(http.StatusNotFound, probe(server, http.MethodGet, i).Code)
+	}
+
+	rec = probe(admin, http.MethodGet, versionPath)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(mediaTypeJSON, rec.Result().Header.Get(headerContentType))
+	var info BuildInfo
+	assert.NoError(kjson.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal("v1.2.3", info.Version)
+	assert.Equal("git-0123abcd", info.VCS)
+	assert.Equal("go1.22.0", info.GoVersion)
+
+	rec = probe(admin, http.MethodPost, healthzPath)
+	assert.Equal(http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal("GET, HEAD", rec.Result().Header.Get(headerAllow))
+
+	assert.NoError(server.Mount([]Route{
+		{
+			Prefix: "/static/",
+			Dir:    true,
+			Path:   "static",
+		},
+	}))
+	assert.Equal(http.StatusOK, probe(admin, http.MethodGet, readyzPath).Code)
+	server.draining.Store(true)
+	assert.Equal(http.StatusServiceUnavailable, probe(admin, http.MethodGet, readyzPath).Code)
+	assert.Equal(http.StatusOK, probe(admin, http.MethodGet, healthzPath).Code)
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	assert := require.New(t)
+
+	rootDir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(rootDir, "static"), 0o755))
+	assert.NoError(os.WriteFile(filepath.Join(rootDir, "static", "index.html"), []byte("hello"), 0o644))
+
+	routes := []Route{
+		{
+			Prefix:       "/static/",
+			Dir:          true,
+			Path:         "static",
+			DisableXAttr: true,
+		},
+	}
+
+	for _, tc := range []struct {
+		Name    string
+		Config  AccessLog
+		Pattern string
+	}{
+		{
+			Name:    "combined",
+			Config:  AccessLog{},
+			Pattern: `^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /static/index\.html\?sig=REDACTED HTTP/1\.1" 200 5 "https://example\.com/" "test\\x22agent" "[^"]+" "/static/" "-" \d+\n$`,
+		},
+		{
+			Name:    "common",
+			Config:  AccessLog{Format: "common"},
+			Pattern: `^192\.0\.2\.1 - - \[[^\]]+\] "GET /static/index\.html\?sig=REDACTED HTTP/1\.1" 200 5\n$`,
+		},
+		{
+			Name: "json",
+			Config: AccessLog{
+				Format: "json",
+				Fields: map[string]string{
+					"remote_ip":  "client",
+					"status":     "status",
+					"bytes":      "size",
+					"user_agent": "ua",
+					"route":      "route",
+				},
+			},
+			Pattern: `^\{"client":"192\.0\.2\.1","status":200,"size":5,"ua":"test\\"agent","route":"/static/"\}\n$`,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			assert := require.New(t)
+
+			var b bytes.Buffer
+			server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+				Instance:        "testinstance",
+				AccessLog:       tc.Config,
+				AccessLogWriter: &b,
+			})
+			assert.NoError(server.Mount(slices.Clone(routes)))
+
+			req := httptest.NewRequest(http.MethodGet, "/static/index.html?sig=secret", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("Referer", "https://example.com/")
+			req.Header.Set("User-Agent", `test"agent`)
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			assert.Equal(http.StatusOK, rec.Code)
+			assert.Regexp(tc.Pattern, b.String())
+		})
+	}
+
+	t.Run("rejects invalid config", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		for _, i := range []AccessLog{
+			{Format: "bogus"},
+			{Format: "json", Fields: map[string]string{"bogus": "bogus"}},
+			{Format: "json", Fields: map[string]string{"status": ""}},
+		} {
+			server := NewServer(klog.Discard{}, kfs.DirFS(rootDir), Config{
+				Instance:  "testinstance",
+				AccessLog: i,
+			})
+			assert.Error(server.Mount(slices.Clone(routes)))
+		}
+	})
+
+	t.Run("reopens file", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		logDir := t.TempDir()
+		name := filepath.Join(logDir, "access.log")
+		f, err := OpenAccessLogFile(name)
+		assert.NoError(err)
+		_, err = f.Write([]byte("first\n"))
+		assert.NoError(err)
+		assert.NoError(os.Rename(name, name+".1"))
+		_, err = f.Write([]byte("second\n"))
+		assert.NoError(err)
+		assert.NoError(f.Reopen())
+		_, err = f.Write([]byte("third\n"))
+		assert.NoError(err)
+		assert.NoError(f.Close())
+		_, err = f.Write([]byte("fourth\n"))
+		assert.Error(err)
+
+		b, err := os.ReadFile(name + ".1")
+		assert.NoError(err)
+		assert.Equal("first\nsecond\n", string(b))
+		b, err = os.ReadFile(name)
+		assert.NoError(err)
+		assert.Equal("third\n", string(b))
+	})
+}
@@ -0,0 +1,115 @@
+package serve
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"xorkevin.dev/kerrors"
+)
+
+const (
+	signURLParamExpires   = "exp"
+	signURLParamSignature = "sig"
+
+	// signKeyMinSize is the minimum size in bytes of a url signing key
+	signKeyMinSize = 16
+
+	redactedValue = "REDACTED"
+)
+
+func validateSignKey(key []byte) error {
+	if len(key) < signKeyMinSize {
+		return kerrors.WithMsg(nil, fmt.Sprintf("Signing key must be at least %d bytes", signKeyMinSize))
+	}
+	return nil
+}
+
+// signURLMAC computes the signature of an escaped url path and its query
+// params other than the signature, which include the expiry. Params are
+// canonicalized by sorting them by key.
+func signURLMAC(key []byte, escapedPath string, q url.Values) string {
+	params := url.Values{}
+	for k, v := range q {
+		if k != signURLParamSignature {
+			params[k] = v
+		}
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(escapedPath))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(params.Encode()))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// SignURL returns a url path signed with key which expires at expires. The
+// path may have a query, which is also signed.
+func SignURL(key []byte, p string, expires time.Time) (string, error) {
+	if err := validateSignKey(key); err != nil {
+		return "", err
+	}
+	p, rawQuery, _ := strings.Cut(p, "?")
+	if !strings.HasPrefix(p, "/") {
+		return "", kerrors.WithMsg(nil, fmt.Sprintf("Path %s must be absolute", p))
+	}
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", kerrors.WithMsg(err, "Invalid query")
+	}
+	if q.Has(signURLParamExpires) || q.Has(signURLParamSignature) {
+		return "", kerrors.WithMsg(nil, fmt.Sprintf("Query may not have params %s or %s", signURLParamExpires, signURLParamSignature))
+	}
+	u := url.URL{
+		Path: p,
+	}
+	q.Set(signURLParamExpires, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(signURLParamSignature, signURLMAC(key, u.EscapedPath(), q))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// verifySignedURL returns an error if a request does not have a valid
+// unexpired signature for its original request path and query
+func verifySignedURL(key []byte, r *http.Request, now time.Time) error {
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		return kerrors.WithKind(err, ErrInvalidReq, "Invalid request uri")
+	}
+	q := u.Query()
+	exp := q.Get(signURLParamExpires)
+	sig := q.Get(signURLParamSignature)
+	if exp == "" || sig == "" {
+		return kerrors.WithKind(nil, ErrForbidden, "Missing url signature")
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return kerrors.WithKind(err, ErrForbidden, "Malformed url expiry")
+	}
+	if !hmac.Equal([]byte(sig), []byte(signURLMAC(key, u.EscapedPath(), q))) {
+		return kerrors.WithKind(nil, ErrForbidden, "Invalid url signature")
+	}
+	if now.Unix() >= expires {
+		return kerrors.WithKind(nil, ErrForbidden, "Signed url expired")
+	}
+	return nil
+}
+
+// redactedReqPath returns the escaped path and query of a url with the url
+// signature redacted
+func redactedReqPath(u *url.URL) string {
+	p := u.EscapedPath()
+	if u.RawQuery == "" {
+		return p
+	}
+	q := u.Query()
+	if q.Has(signURLParamSignature) {
+		q.Set(signURLParamSignature, redactedValue)
+	}
+	return p + "?" + q.Encode()
+}
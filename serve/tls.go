@@ -0,0 +1,334 @@
+package serve
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"xorkevin.dev/kerrors"
+	"xorkevin.dev/klog"
+)
+
+type (
+	TLSOpts struct {
+		CertFile       string
+		KeyFile        string
+		MinVersion     uint16
+		CipherSuites   []uint16
+		ReloadInterval time.Duration
+		HSTS           string
+		RedirectPort   int
+		ClientCAFiles  []string
+	}
+
+	// ClientCert requires a verified tls client certificate for a route
+	//
+	// Subjects are allowed subject common names, and SANs are allowed dns,
+	// email, ip, or uri subject alternative names. Any verified certificate is
+	// allowed if both are empty. Routes requiring a client certificate are
+	// rejected unless a tls client ca and a tls listener are configured.
+	ClientCert struct {
+		Required bool     `mapstructure:"required"`
+		Subjects []string `mapstructure:"subjects"`
+		SANs     []string `mapstructure:"sans"`
+	}
+
+	// clientCertSupport is whether the listeners of a server are able to
+	// verify client certificates
+	clientCertSupport struct {
+		clientCA    bool
+		tlsListener bool
+	}
+
+	certReloader struct {
+		log      *klog.LevelLogger
+		certFile string
+		keyFile  string
+		cert     atomic.Pointer[tls.Certificate]
+		tag      string
+	}
+)
+
+const (
+	headerStrictTransportSecurity = "Strict-Transport-Security"
+)
+
+// Enabled returns if tls is configured
+func (o TLSOpts) Enabled() bool {
+	return o.CertFile != "" || o.KeyFile != ""
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a tls version string like 1.2 or 1.3
+func ParseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, kerrors.WithMsg(nil, fmt.Sprintf("Invalid tls version %s", s))
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses a list of cipher suite names
+//
+// Only cipher suites without known security issues are allowed. Cipher suites
+// are not configurable for TLS 1.3.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	suites := map[string]uint16{}
+	for _, i := range tls.CipherSuites() {
+		suites[i.Name] = i.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, i := range names {
+		id, ok := suites[i]
+		if !ok {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("Invalid or insecure cipher suite %s", i))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func newCertReloader(log *klog.LevelLogger, certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, kerrors.WithMsg(nil, "Both tls cert and key files must be provided")
+	}
+	c := &certReloader{
+		log:      log,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	tag, err := c.statTag()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(tag); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) statTag() (string, error) {
+	certStat, err := os.Stat(c.certFile)
+	if err != nil {
+		return "", kerrors.WithMsg(err, fmt.Sprintf("Failed to stat tls cert file %s", c.certFile))
+	}
+	keyStat, err := os.Stat(c.keyFile)
+	if err != nil {
+		return "", kerrors.WithMsg(err, fmt.Sprintf("Failed to stat tls key file %s", c.keyFile))
+	}
+	return statToTag(certStat) + checksumSeparator + statToTag(keyStat), nil
+}
+
+func (c *certReloader) load(tag string) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return kerrors.WithMsg(err, "Failed to load tls cert key pair")
+	}
+	c.cert.Store(&cert)
+	c.tag = tag
+	return nil
+}
+
+// reloadIfChanged reloads the cert key pair if either file has changed. The
+// previous cert key pair continues to be served on failure.
+func (c *certReloader) reloadIfChanged(ctx context.Context) {
+	tag, err := c.statTag()
+	if err != nil {
+		c.log.Err(ctx, err)
+		return
+	}
+	if tag == c.tag {
+		return
+	}
+	if err := c.load(tag); err != nil {
+		c.log.Err(ctx, err)
+		return
+	}
+	c.log.Info(ctx, "Reloaded tls cert key pair",
+		klog.AString("tls.cert", c.certFile),
+		klog.AString("tls.key", c.keyFile),
+	)
+}
+
+func (c *certReloader) watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.reloadIfChanged(ctx)
+		}
+	}
+}
+
+func (c *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// loadClientCAs loads the client ca bundles used to verify client certificates
+func loadClientCAs(files []string) (*x509.CertPool, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	for _, i := range files {
+		b, err := os.ReadFile(i)
+		if err != nil {
+			return nil, kerrors.WithMsg(err, fmt.Sprintf("Failed to read tls client ca file %s", i))
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, kerrors.WithMsg(nil, fmt.Sprintf("No certs in tls client ca file %s", i))
+		}
+	}
+	return pool, nil
+}
+
+func newTLSConfig(certs *certReloader, opts TLSOpts, clientCAs *x509.CertPool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     opts.MinVersion,
+		CipherSuites:   opts.CipherSuites,
+		GetCertificate: certs.getCertificate,
+	}
+	if clientCAs != nil {
+		// client certs are optional at the connection, and are required by
+		// routes
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
+
+func (c ClientCert) enabled() bool {
+	return c.Required || len(c.Subjects) > 0 || len(c.SANs) > 0
+}
+
+// checkRoutes returns an error if a route requires a client certificate that
+// would never be verified, which would otherwise forbid every request to the
+// route
+func (c clientCertSupport) checkRoutes(routes []Route) error {
+	for _, i := range routes {
+		if !i.ClientCert.enabled() {
+			continue
+		}
+		if !c.clientCA {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Route %s requires a client cert but no tls client ca is configured", i.Prefix))
+		}
+		if !c.tlsListener {
+			return kerrors.WithMsg(nil, fmt.Sprintf("Route %s requires a client cert but no tls listeners are configured", i.Prefix))
+		}
+	}
+	return nil
+}
+
+// getVerifiedClientCert returns the verified leaf client certificate of a
+// request
+func getVerifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, i := range cert.IPAddresses {
+		sans = append(sans, i.String())
+	}
+	for _, i := range cert.URIs {
+		sans = append(sans, i.String())
+	}
+	return sans
+}
+
+// checkClientCert returns an error if a request does not have a verified
+// client certificate allowed by the route
+func checkClientCert(r *http.Request, prefix string, c ClientCert) error {
+	if !c.enabled() {
+		return nil
+	}
+	cert := getVerifiedClientCert(r)
+	if cert == nil {
+		return kerrors.WithKind(nil, ErrForbidden, fmt.Sprintf("Missing verified client cert for route %s", prefix))
+	}
+	if len(c.Subjects) == 0 && len(c.SANs) == 0 {
+		return nil
+	}
+	if slices.Contains(c.Subjects, cert.Subject.CommonName) {
+		return nil
+	}
+	for _, i := range certSANs(cert) {
+		if slices.Contains(c.SANs, i) {
+			return nil
+		}
+	}
+	return kerrors.WithKind(nil, ErrForbidden, fmt.Sprintf("Client cert %s not allowed for route %s", cert.Subject.String(), prefix))
+}
+
+func hstsHandler(hsts string, next http.Handler) http.Handler {
+	if hsts == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set(headerStrictTransportSecurity, hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type (
+	httpsRedirect struct {
+		port int
+	}
+)
+
+func (h *httpsRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if host == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if h.port != 0 && h.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(h.port))
+	} else if strings.Contains(host, ":") {
+		// ipv6 literal
+		host = "[" + host + "]"
+	}
+	u := *r.URL
+	u.Scheme = "https"
+	u.Host = host
+	http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+}
@@ -116,35 +116,95 @@ func (t *Tree) checksumFile(ctx context.Context, visitedSet map[string]struct{},
 		xattrChecksum = defaultXAttrChecksum
 	}
 
-	if err := t.hashFileAndStore(ctx, xattrChecksum, visitedSet, p, force); err != nil {
+	if err := t.checksumVariants(ctx, xattrChecksum, visitedSet, route, name, p, true, force); err != nil {
 		return err
 	}
 
-	for _, i := range route.Encodings {
+	for _, i := range route.Localize.Languages {
+		if err := t.checksumVariants(ctx, xattrChecksum, visitedSet, route, localizedName(name, i), localizedName(p, i), false, force); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checksumVariants checksums a file along with its variants and encodings,
+// where name is used to match route rules and p is the file path
+func (t *Tree) checksumVariants(ctx context.Context, xattrChecksum string, visitedSet map[string]struct{}, route Route, name, p string, required bool, force bool) error {
+	ok := required
+	if !ok {
+		var err error
+		ok, err = t.isFile(p)
+		if err != nil {
+			return err
+		}
+	}
+	if ok {
+		if err := t.hashFileAndStore(ctx, xattrChecksum, visitedSet, p, force); err != nil {
+			return err
+		}
+	}
+	if err := t.checksumEncodings(ctx, xattrChecksum, visitedSet, route, name, p, force); err != nil {
+		return err
+	}
+
+	for _, i := range route.Variants {
 		if i.match != nil {
 			if !i.match.MatchString(name) {
 				continue
 			}
 		}
-		alt := p + i.Ext
-		stat, err := fs.Stat(t.dir, alt)
+		ok, err := t.isFile(p + i.Ext)
 		if err != nil {
-			if errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := t.hashFileAndStore(ctx, xattrChecksum, visitedSet, p+i.Ext, force); err != nil {
+			return err
+		}
+		if err := t.checksumEncodings(ctx, xattrChecksum, visitedSet, route, name+i.Ext, p+i.Ext, force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tree) checksumEncodings(ctx context.Context, xattrChecksum string, visitedSet map[string]struct{}, route Route, name, p string, force bool) error {
+	for _, i := range route.Encodings {
+		if i.match != nil {
+			if !i.match.MatchString(name) {
 				continue
 			}
-			return kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", alt))
 		}
-		if stat.IsDir() {
+		alt := p + i.Ext
+		ok, err := t.isFile(alt)
+		if err != nil {
+			return err
+		}
+		if !ok {
 			continue
 		}
 		if err := t.hashFileAndStore(ctx, xattrChecksum, visitedSet, alt, force); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
+func (t *Tree) isFile(p string) (bool, error) {
+	stat, err := fs.Stat(t.dir, p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, kerrors.WithMsg(err, fmt.Sprintf("Failed to stat file %s", p))
+	}
+	return !stat.IsDir(), nil
+}
+
 func (t *Tree) hashFileAndStore(ctx context.Context, xattrChecksum string, visitedSet map[string]struct{}, p string, force bool) error {
 	if _, ok := visitedSet[p]; ok {
 		t.log.Debug(ctx, "Skipping rehashing file",